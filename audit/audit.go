@@ -0,0 +1,388 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/atomicfile"
+)
+
+// EventType is the kind of thing an audit Event records
+type EventType string
+
+const (
+	// EventPromptCreated is recorded whenever a client asks for a new MFA prompt on a key
+	EventPromptCreated EventType = "prompt_created"
+	// EventDuoResponse is recorded for every answer DUO gives us about a prompt
+	EventDuoResponse EventType = "duo_response"
+	// EventStateTransition is recorded whenever a prompt moves to allowed or denied
+	EventStateTransition EventType = "state_transition"
+	// EventCheck is recorded for every check against a key, successful or not
+	EventCheck EventType = "check"
+	// EventAdminAction is recorded for anything done through admin endpoints
+	EventAdminAction EventType = "admin_action"
+	// EventEnrollment is recorded whenever a user starts enrolling a device, or an enrollment is checked on
+	EventEnrollment EventType = "enrollment"
+)
+
+// The PrevHash of the very first entry in a log
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// An Event is a single entry in the audit log
+type Event struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Type      EventType         `json:"type"`
+	Key       string            `json:"key,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Client    string            `json:"client,omitempty"`
+	SourceIP  string            `json:"sourceIP,omitempty"`
+	RequestID string            `json:"requestID,omitempty"`
+	TxID      string            `json:"txid,omitempty"`
+	Factor    string            `json:"factor,omitempty"`
+	Result    string            `json:"result,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	// Whether the prompt went through a break-glass provider rather than the usual one
+	BreakGlass bool   `json:"breakGlass,omitempty"`
+	PrevHash   string `json:"prevHash"`
+	Hash       string `json:"hash"`
+}
+
+// computeHash hashes everything in the event but its own Hash, chained to PrevHash
+func (e Event) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", errors.Wrap(err, "error serializing audit event")
+	}
+
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), b...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// The head file remembers the last entry written, so truncating the log is detectable
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func headPath(path string) string {
+	return path + ".head"
+}
+
+// ErrBroken is returned by Record once the log on disk might not match the chain any more, because an entry couldn't
+// be taken back or synced.  Nothing more is appended to it, since entries after that couldn't be verified.
+var ErrBroken = errors.New("audit log chain is broken, not recording any more entries")
+
+// A Sink is somewhere else audit events are sent once they've been chained, like a SIEM
+type Sink interface {
+	Write(e Event) error
+	Close() error
+}
+
+// A Log is an append-only, hash-chained audit log on disk
+type Log struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	sinks []Sink
+	// Seq of the next entry to be written
+	seq  uint64
+	last string
+	// Why the chain is broken, if it is
+	broken error
+}
+
+// Open opens the audit log at path for appending, creating it if it doesn't exist, and forwards every
+// entry on to sinks.  An existing log is verified first, we refuse to keep appending to a chain that's
+// been tampered with.  If path is empty, entries are still chained but only sent to sinks.
+func Open(path string, sinks ...Sink) (*Log, error) {
+	l := Log{
+		path:  path,
+		sinks: sinks,
+		last:  genesisHash,
+	}
+
+	if path == "" {
+		return &l, nil
+	}
+
+	var c chain
+	if _, err := os.Stat(path); err == nil {
+		if c, err = verify(path); err != nil {
+			return nil, errors.Wrapf(err, "existing audit log %s failed verification", path)
+		}
+		l.seq = uint64(c.n)
+		l.last = c.last
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening audit log %s", path)
+	}
+	l.f = f
+
+	if err := l.repair(c); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "error repairing audit log %s", path)
+	}
+
+	return &l, nil
+}
+
+// repair finishes what a crash while recording the last entry left undone: it cuts off an entry that was only
+// partly written, and moves the head up to the last entry if it was never moved.
+func (l *Log) repair(c chain) error {
+	if c.torn {
+		log.Warnf("Audit log %s ends with a partly written entry, cutting it off", l.path)
+		if err := l.f.Truncate(c.size); err != nil {
+			return errors.Wrap(err, "error cutting off partly written entry")
+		}
+	}
+	if !c.torn && !c.headBehind {
+		return nil
+	}
+
+	if err := l.f.Sync(); err != nil {
+		return errors.Wrap(err, "error syncing audit log")
+	}
+	if c.headBehind {
+		log.Warnf("Audit log %s head is behind its last entry %d, moving it up", l.path, c.n-1)
+		return writeHead(l.path, head{Seq: uint64(c.n - 1), Hash: c.last})
+	}
+	return nil
+}
+
+// Record chains e onto the end of the log.  Seq, PrevHash and Hash are filled-in here,
+// as is Time if the caller didn't set it.
+func (l *Log) Record(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.broken != nil {
+		return errors.Wrap(ErrBroken, l.broken.Error())
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq = l.seq
+	e.PrevHash = l.last
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	if l.f != nil {
+		if err := l.write(e); err != nil {
+			return err
+		}
+	}
+
+	// The entry is in the log, so it's part of the chain even if what follows fails
+	l.seq++
+	l.last = e.Hash
+
+	var recordErr error
+	if l.f != nil {
+		recordErr = l.commit(e)
+	}
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(e); err != nil && recordErr == nil {
+			recordErr = errors.Wrap(err, "error sending audit event to sink")
+		}
+	}
+
+	return recordErr
+}
+
+// write appends e to the log.  If it fails part way, whatever was written is cut off again, and if that fails
+// too the chain is broken.
+func (l *Log) write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error serializing audit event")
+	}
+
+	info, err := l.f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "error finding the end of the audit log")
+	}
+
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		if terr := l.f.Truncate(info.Size()); terr != nil {
+			l.broken = errors.Wrapf(terr, "error removing partly written entry %d after %v", e.Seq, err)
+			return errors.Wrap(ErrBroken, l.broken.Error())
+		}
+		return errors.Wrap(err, "error writing audit event")
+	}
+	return nil
+}
+
+// commit makes e, just written, durable and moves the head up to it.  If it can't be synced, it might be lost
+// while later entries chained to it aren't, so the chain is broken.  A head left behind is caught up by the next
+// entry, or by Open if there isn't one before a restart.
+func (l *Log) commit(e Event) error {
+	if err := l.f.Sync(); err != nil {
+		l.broken = errors.Wrapf(err, "error syncing entry %d", e.Seq)
+		return errors.Wrap(ErrBroken, l.broken.Error())
+	}
+	return writeHead(l.path, head{Seq: e.Seq, Hash: e.Hash})
+}
+
+// Close closes the underlying file and every sink
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var closeErr error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			closeErr = err
+		}
+	}
+
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+func writeHead(path string, h head) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return errors.Wrap(err, "error serializing audit log head")
+	}
+
+	return errors.Wrap(atomicfile.WriteFile(headPath(path), b, 0600), "error writing audit log head")
+}
+
+// Verify checks every entry in the audit log at path against the chain, and the last entry against the head file.
+// It returns the number of entries verified.  What a crash while recording an entry can leave behind, a partly
+// written last entry or a head one entry behind, isn't an error, Open repairs it.
+func Verify(path string) (int, error) {
+	c, err := verify(path)
+	return c.n, err
+}
+
+// chain is what verify found in a log
+type chain struct {
+	// How many entries verified, and the hashes of the last two
+	n    int
+	last string
+	prev string
+	// Where the last whole entry ends, and whether a partly written one follows it
+	size int64
+	torn bool
+	// Whether the head is at the entry before the last
+	headBehind bool
+}
+
+func verify(path string) (chain, error) {
+	c := chain{
+		last: genesisHash,
+		prev: genesisHash,
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return c, errors.Wrapf(err, "error opening audit log %s", path)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Every entry is written whole with its newline, so anything after the last one was cut short
+			c.torn = len(line) > 0
+			break
+		}
+		if err != nil {
+			return c, errors.Wrapf(err, "error reading audit log %s", path)
+		}
+
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			return c, errors.Wrapf(err, "entry %d is not valid", c.n)
+		}
+
+		if e.Seq != uint64(c.n) {
+			return c, errors.Errorf("entry %d has seq %d, entries are missing or reordered", c.n, e.Seq)
+		}
+
+		if e.PrevHash != c.last {
+			return c, errors.Errorf("entry %d doesn't chain to the entry before it", c.n)
+		}
+
+		hash, err := e.computeHash()
+		if err != nil {
+			return c, err
+		}
+		if hash != e.Hash {
+			return c, errors.Errorf("entry %d has been modified", c.n)
+		}
+
+		c.prev, c.last = c.last, e.Hash
+		c.size += int64(len(line))
+		c.n++
+	}
+
+	b, err := ioutil.ReadFile(headPath(path))
+	if os.IsNotExist(err) && c.n <= 1 {
+		// Nothing has ever been recorded, or the head was never written for the first entry
+		c.headBehind = c.n == 1
+		return c, nil
+	}
+	if err != nil {
+		return c, errors.Wrap(err, "error reading audit log head, can't check for truncation")
+	}
+
+	var h head
+	if err := json.Unmarshal(b, &h); err != nil {
+		return c, errors.Wrap(err, "audit log head is not valid")
+	}
+
+	switch {
+	case c.n >= 1 && h.Seq == uint64(c.n-1) && h.Hash == c.last:
+	case c.n >= 2 && h.Seq == uint64(c.n-2) && h.Hash == c.prev:
+		c.headBehind = true
+	default:
+		return c, errors.Errorf("audit log ends at entry %d but its head is at entry %d, the log has been truncated", c.n-1, h.Seq)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type memorySink struct {
+	events []Event
+}
+
+func (m *memorySink) Write(e Event) error {
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	return nil
+}
+
+func tempLog(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "audit.log")
+}
+
+func record(t *testing.T, l *Log, n int) {
+	for i := 0; i < n; i++ {
+		if err := l.Record(Event{Type: EventCheck, Key: "k", Result: "valid"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	path := tempLog(t)
+	sink := &memorySink{}
+
+	l, err := Open(path, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, 3)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := Verify(path); err != nil || n != 3 {
+		t.Fatalf("expected 3 verified entries, got %d: %v", n, err)
+	}
+
+	if len(sink.events) != 3 {
+		t.Fatalf("expected 3 events sent to the sink, got %d", len(sink.events))
+	}
+	if sink.events[0].PrevHash != genesisHash {
+		t.Error("first entry doesn't chain to the genesis hash")
+	}
+	for i, e := range sink.events {
+		if e.Seq != uint64(i) {
+			t.Errorf("entry %d has seq %d", i, e.Seq)
+		}
+		if i > 0 && e.PrevHash != sink.events[i-1].Hash {
+			t.Errorf("entry %d doesn't chain to the entry before it", i)
+		}
+	}
+
+	// Reopening carries on the chain
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, 2)
+	l.Close()
+
+	if n, err := Verify(path); err != nil || n != 5 {
+		t.Fatalf("expected 5 verified entries after reopening, got %d: %v", n, err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	for name, tamper := range map[string]func(lines []string) []string{
+		"modified": func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"result":"valid"`, `"result":"invalid"`, 1)
+			return lines
+		},
+		"removed": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		},
+		"truncated": func(lines []string) []string {
+			return lines[:2]
+		},
+	} {
+		path := tempLog(t)
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record(t, l, 3)
+		l.Close()
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := tamper(strings.Split(strings.TrimSpace(string(b)), "\n"))
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Verify(path); err == nil {
+			t.Errorf("%s: log verified", name)
+		}
+		if _, err := Open(path); err == nil {
+			t.Errorf("%s: log was opened for appending", name)
+		}
+	}
+}
+
+// Each of these is what a crash while recording the last entry can leave behind, which Open repairs
+func TestRepairAfterCrash(t *testing.T) {
+	for name, crash := range map[string]func(path string, events []Event){
+		"head behind": func(path string, events []Event) {
+			last := events[len(events)-2]
+			if err := writeHead(path, head{Seq: last.Seq, Hash: last.Hash}); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"no head after the first entry": func(path string, events []Event) {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := strings.SplitAfter(string(b), "\n")[0]
+			if err := ioutil.WriteFile(path, []byte(first), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(headPath(path)); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"torn last entry": func(path string, events []Event) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.WriteString(`{"seq":3,"time":"20`); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		path := tempLog(t)
+		sink := &memorySink{}
+		l, err := Open(path, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record(t, l, 3)
+		l.Close()
+
+		crash(path, sink.events)
+
+		if _, err := Verify(path); err != nil {
+			t.Errorf("%s: log didn't verify: %v", name, err)
+		}
+		l, err = Open(path)
+		if err != nil {
+			t.Errorf("%s: log wasn't opened: %v", name, err)
+			continue
+		}
+		record(t, l, 1)
+		l.Close()
+
+		n, err := Verify(path)
+		if err != nil {
+			t.Errorf("%s: log didn't verify once repaired: %v", name, err)
+		}
+		b, err := ioutil.ReadFile(headPath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h head
+		if err := json.Unmarshal(b, &h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Seq != uint64(n-1) {
+			t.Errorf("%s: head is at entry %d, the log ends at %d", name, h.Seq, n-1)
+		}
+	}
+}
+
+func TestHeadTooFarBehind(t *testing.T) {
+	path := tempLog(t)
+	sink := &memorySink{}
+	l, err := Open(path, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, 3)
+	l.Close()
+
+	// More than a crash can explain
+	first := sink.events[0]
+	if err := writeHead(path, head{Seq: first.Seq, Hash: first.Hash}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("opened a log whose head is two entries behind")
+	}
+}
+
+func TestBrokenOnWriteFailure(t *testing.T) {
+	path := tempLog(t)
+	sink := &memorySink{}
+
+	l, err := Open(path, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, 1)
+
+	// Neither writing to nor truncating a read-only file works, so the entry can't be taken back
+	l.f.Close()
+	if l.f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Record(Event{Type: EventCheck}); errors.Cause(err) != ErrBroken {
+		t.Fatalf("expected the chain to be broken, got %v", err)
+	}
+	if err := l.Record(Event{Type: EventCheck}); errors.Cause(err) != ErrBroken {
+		t.Errorf("expected nothing more to be recorded once broken, got %v", err)
+	}
+	if len(sink.events) != 1 {
+		t.Errorf("expected entries that weren't written not to be sent to sinks, got %d", len(sink.events))
+	}
+	l.Close()
+
+	if n, err := Verify(path); err != nil || n != 1 {
+		t.Errorf("expected the entry written before the failure to verify, got %d: %v", n, err)
+	}
+}
+
+func TestNoFile(t *testing.T) {
+	sink := &memorySink{}
+	l, err := Open("", sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, 2)
+	if len(sink.events) != 2 || sink.events[1].PrevHash != sink.events[0].Hash {
+		t.Errorf("expected chained events to still be sent to sinks, got %+v", sink.events)
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/atomicfile"
+)
+
+const (
+	// authpriv, security/authorization messages
+	syslogFacility = 10
+
+	defaultSyslogBuffer = 1000
+	syslogDialTimeout   = 5 * time.Second
+	syslogWriteTimeout  = 5 * time.Second
+	// How long to wait before trying to reconnect to a collector that's down
+	syslogRetryInterval = 10 * time.Second
+
+	// Duo's auth and auth_status status values we call out on their own
+	duoStatusFraud     = "fraud"
+	duoStatusLockedOut = "locked_out"
+)
+
+// Syslog severities, RFC5424 section 6.2.1
+const (
+	severityAlert   = 1
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+// SyslogConfig is where and how to send audit events over syslog
+type SyslogConfig struct {
+	// One of udp, tcp or tls
+	Network string
+	Addr    string
+	// Optional PEM bundle to verify the collector with over tls, defaults to the system roots
+	CAFile string
+
+	// Product version to report in CEF headers
+	Version string
+
+	// How many events to hold in memory before spilling to disk, defaults to defaultSyslogBuffer
+	Buffer int
+	// Optional, events that can't be delivered are appended here and replayed once the collector is back.
+	// Without this, undeliverable events are dropped.
+	SpillFile string
+}
+
+// A SyslogSink sends a subset of audit events (those a SIEM cares about) as RFC5424 syslog
+// messages with a Common Event Format payload
+type SyslogSink struct {
+	cfg       SyslogConfig
+	hostname  string
+	tlsConfig *tls.Config
+
+	queue chan string
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	conn net.Conn
+	// Guards the spill file, which both Write and the sender goroutine may touch
+	spillMu sync.Mutex
+}
+
+// cefClass is how a particular kind of audit event shows up in CEF
+type cefClass struct {
+	signatureID string
+	name        string
+	// CEF severity, 0-10
+	severity int
+	// syslog severity
+	syslogSeverity int
+}
+
+var (
+	cefPromptIssued   = cefClass{"prompt_issued", "MFA prompt issued", 3, severityInfo}
+	cefPromptApproved = cefClass{"prompt_approved", "MFA prompt approved", 3, severityNotice}
+	cefPromptDenied   = cefClass{"prompt_denied", "MFA prompt denied", 6, severityWarning}
+	cefFraudReported  = cefClass{"fraud_reported", "MFA fraud reported", 10, severityAlert}
+	cefLockout        = cefClass{"lockout", "MFA user locked out", 8, severityWarning}
+	cefBreakGlass     = cefClass{"break_glass", "MFA break-glass used", 9, severityAlert}
+)
+
+// classify returns how e is reported, and whether it's reported at all.
+// Everything to do with a break-glass prompt is reported, and at least as loudly as cefBreakGlass.
+func classify(e Event) (cefClass, bool) {
+	class, ok := classifyType(e)
+	if !e.BreakGlass {
+		return class, ok
+	}
+	if !ok {
+		return cefBreakGlass, true
+	}
+
+	class.signatureID = cefBreakGlass.signatureID + "_" + class.signatureID
+	class.name = "Break-glass " + class.name
+	if class.severity < cefBreakGlass.severity {
+		class.severity = cefBreakGlass.severity
+	}
+	if class.syslogSeverity > cefBreakGlass.syslogSeverity {
+		class.syslogSeverity = cefBreakGlass.syslogSeverity
+	}
+	return class, true
+}
+
+func classifyType(e Event) (cefClass, bool) {
+	switch e.Type {
+	case EventPromptCreated:
+		return cefPromptIssued, true
+	case EventStateTransition:
+		switch e.Result {
+		case "allowed":
+			return cefPromptApproved, true
+		case "denied":
+			return cefPromptDenied, true
+		}
+	case EventDuoResponse:
+		switch e.Metadata["duoStatus"] {
+		case duoStatusFraud:
+			return cefFraudReported, true
+		case duoStatusLockedOut:
+			return cefLockout, true
+		}
+	}
+	return cefClass{}, false
+}
+
+// NewSyslogSink validates cfg and starts delivering to the collector in the background.
+// Failing to reach the collector isn't an error here, events are buffered until it's reachable.
+func NewSyslogSink(cfg SyslogConfig) (*SyslogSink, error) {
+	switch cfg.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, errors.Errorf("syslog network must be one of udp, tcp or tls, not '%s'", cfg.Network)
+	}
+
+	if cfg.Addr == "" {
+		return nil, errors.New("syslog addr must be set")
+	}
+
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = defaultSyslogBuffer
+	}
+
+	s := SyslogSink{
+		cfg:   cfg,
+		queue: make(chan string, cfg.Buffer),
+		done:  make(chan struct{}),
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	s.hostname = hostname
+
+	if cfg.Network == "tls" {
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid syslog addr %s", cfg.Addr)
+		}
+		s.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+		if cfg.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading syslog CA bundle %s", cfg.CAFile)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no certificates found in syslog CA bundle %s", cfg.CAFile)
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return &s, nil
+}
+
+// Write queues e for delivery, if it's an event the SIEM cares about.  It never blocks on the network,
+// if the queue is full the event goes straight to the spill file.
+func (s *SyslogSink) Write(e Event) error {
+	class, ok := classify(e)
+	if !ok {
+		return nil
+	}
+
+	msg := s.format(e, class)
+
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		return s.spill([]string{msg})
+	}
+}
+
+// Close stops delivery, spilling anything still queued
+func (s *SyslogSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	var pending []string
+	for {
+		select {
+		case msg := <-s.queue:
+			pending = append(pending, msg)
+		default:
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			return s.spill(pending)
+		}
+	}
+}
+
+func (s *SyslogSink) run() {
+	defer s.wg.Done()
+
+	for {
+		// Anything spilled while the collector was down goes out before anything new
+		if err := s.replay(); err != nil {
+			log.Warn(errors.Wrap(err, "Error delivering spilled audit events to syslog, retrying later"))
+			if !s.wait() {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.queue:
+			if err := s.send(msg); err != nil {
+				log.Warn(errors.Wrap(err, "Error delivering audit event to syslog, spilling"))
+				if err := s.spill([]string{msg}); err != nil {
+					log.Error(err)
+				}
+				if !s.wait() {
+					return
+				}
+			}
+		}
+	}
+}
+
+// wait backs off after a failure, returning false if the sink was closed in the meantime
+func (s *SyslogSink) wait() bool {
+	select {
+	case <-s.done:
+		return false
+	case <-time.After(syslogRetryInterval):
+		return true
+	}
+}
+
+func (s *SyslogSink) dial() (net.Conn, error) {
+	dialer := net.Dialer{Timeout: syslogDialTimeout}
+	if s.cfg.Network == "tls" {
+		return tls.DialWithDialer(&dialer, "tcp", s.cfg.Addr, s.tlsConfig)
+	}
+	return dialer.Dial(s.cfg.Network, s.cfg.Addr)
+}
+
+func (s *SyslogSink) send(msg string) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to syslog collector %s", s.cfg.Addr)
+		}
+		s.conn = conn
+	}
+
+	// Streams need octet-counting framing (RFC6587/RFC5425), datagrams are one message each
+	frame := msg
+	if s.cfg.Network != "udp" {
+		frame = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout)); err != nil {
+		return s.reset(err)
+	}
+	if _, err := s.conn.Write([]byte(frame)); err != nil {
+		return s.reset(err)
+	}
+
+	return nil
+}
+
+// reset drops a broken connection, so the next send reconnects
+func (s *SyslogSink) reset(err error) error {
+	s.conn.Close()
+	s.conn = nil
+	return errors.Wrapf(err, "error writing to syslog collector %s", s.cfg.Addr)
+}
+
+// spill appends messages to the spill file, one per line
+func (s *SyslogSink) spill(msgs []string) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	if s.cfg.SpillFile == "" {
+		return errors.Errorf("dropped %d audit events, syslog collector unavailable and no spill file configured", len(msgs))
+	}
+
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+
+	f, err := os.OpenFile(s.cfg.SpillFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "error opening syslog spill file %s", s.cfg.SpillFile)
+	}
+	defer f.Close()
+
+	for _, msg := range msgs {
+		if _, err := f.WriteString(msg + "\n"); err != nil {
+			return errors.Wrapf(err, "error writing syslog spill file %s", s.cfg.SpillFile)
+		}
+	}
+
+	return nil
+}
+
+// replay sends everything in the spill file, leaving whatever couldn't be sent in it.  The spill file is only
+// locked while it's read and rewritten, not while sending, so Write never waits on the collector.
+func (s *SyslogSink) replay() error {
+	if s.cfg.SpillFile == "" {
+		return nil
+	}
+
+	s.spillMu.Lock()
+	msgs, err := s.readSpill()
+	s.spillMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	var sendErr error
+	for _, msg := range msgs {
+		if sendErr = s.send(msg); sendErr != nil {
+			break
+		}
+		sent++
+	}
+
+	if err := s.dropSpilled(sent); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// dropSpilled removes the first n messages from the spill file.  Only replay takes messages out of it, and
+// anything spilled since it read the file was appended, so those are the n it sent.
+func (s *SyslogSink) dropSpilled(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+
+	msgs, err := s.readSpill()
+	if err != nil {
+		return err
+	}
+	if n >= len(msgs) {
+		return errors.Wrapf(os.Remove(s.cfg.SpillFile), "error removing syslog spill file %s", s.cfg.SpillFile)
+	}
+
+	remaining := strings.Join(msgs[n:], "\n") + "\n"
+	return errors.Wrapf(atomicfile.WriteFile(s.cfg.SpillFile, []byte(remaining), 0600), "error rewriting syslog spill file %s", s.cfg.SpillFile)
+}
+
+// readSpill returns every message in the spill file, spillMu must be held
+func (s *SyslogSink) readSpill() ([]string, error) {
+	f, err := os.Open(s.cfg.SpillFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening syslog spill file %s", s.cfg.SpillFile)
+	}
+	defer f.Close()
+
+	var msgs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		msgs = append(msgs, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading syslog spill file %s", s.cfg.SpillFile)
+	}
+	return msgs, nil
+}
+
+// format renders e as an RFC5424 message with a CEF payload
+func (s *SyslogSink) format(e Event, class cefClass) string {
+	pri := syslogFacility*8 + class.syslogSeverity
+
+	ext := []string{
+		"rt=" + strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10),
+		"act=" + cefEscapeExt(e.Result),
+		"suser=" + cefEscapeExt(e.User),
+		"src=" + cefEscapeExt(e.SourceIP),
+		"externalId=" + cefEscapeExt(e.RequestID),
+		"msg=" + cefEscapeExt(e.Message),
+		"cs1Label=key cs1=" + cefEscapeExt(e.Key),
+		"cs2Label=txid cs2=" + cefEscapeExt(e.TxID),
+		"cs3Label=client cs3=" + cefEscapeExt(e.Client),
+		"cs4Label=factor cs4=" + cefEscapeExt(e.Factor),
+		"cs5Label=auditHash cs5=" + cefEscapeExt(e.Hash),
+		"cn1Label=auditSeq cn1=" + strconv.FormatUint(e.Seq, 10),
+	}
+
+	cef := fmt.Sprintf("CEF:0|Palantir|duo-bot|%s|%s|%s|%d|%s",
+		cefEscapeHeader(s.cfg.Version),
+		class.signatureID,
+		cefEscapeHeader(class.name),
+		class.severity,
+		strings.Join(ext, " "),
+	)
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	return fmt.Sprintf("<%d>1 %s %s duo-bot %d %s - %s",
+		pri,
+		e.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		os.Getpid(),
+		class.signatureID,
+		cef,
+	)
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtEscaper    = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func cefEscapeHeader(s string) string {
+	return cefHeaderEscaper.Replace(s)
+}
+
+func cefEscapeExt(s string) string {
+	return cefExtEscaper.Replace(s)
+}
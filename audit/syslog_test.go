@@ -0,0 +1,224 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	for name, tc := range map[string]struct {
+		event    Event
+		id       string
+		reported bool
+	}{
+		"created":    {Event{Type: EventPromptCreated}, "prompt_issued", true},
+		"allowed":    {Event{Type: EventStateTransition, Result: "allowed"}, "prompt_approved", true},
+		"denied":     {Event{Type: EventStateTransition, Result: "denied"}, "prompt_denied", true},
+		"fraud":      {Event{Type: EventDuoResponse, Metadata: map[string]string{"duoStatus": "fraud"}}, "fraud_reported", true},
+		"locked out": {Event{Type: EventDuoResponse, Metadata: map[string]string{"duoStatus": "locked_out"}}, "lockout", true},
+		"pushed":     {Event{Type: EventDuoResponse, Metadata: map[string]string{"duoStatus": "pushed"}}, "", false},
+		"check":      {Event{Type: EventCheck}, "", false},
+		"break-glass check": {
+			Event{Type: EventCheck, BreakGlass: true}, "break_glass", true,
+		},
+		"break-glass approval": {
+			Event{Type: EventStateTransition, Result: "allowed", BreakGlass: true}, "break_glass_prompt_approved", true,
+		},
+	} {
+		class, ok := classify(tc.event)
+		if ok != tc.reported || class.signatureID != tc.id {
+			t.Errorf("%s: classified as %q (reported %v), want %q (reported %v)", name, class.signatureID, ok, tc.id, tc.reported)
+		}
+		if tc.event.BreakGlass && (class.severity < cefBreakGlass.severity || class.syslogSeverity > cefBreakGlass.syslogSeverity) {
+			t.Errorf("%s: break-glass reported less loudly than %+v: %+v", name, cefBreakGlass, class)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	s := SyslogSink{cfg: SyslogConfig{Version: "1.0|beta"}, hostname: "host"}
+	e := Event{
+		Seq:     7,
+		Time:    time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:    EventStateTransition,
+		Result:  "denied",
+		User:    "alice",
+		Key:     "deploy=prod",
+		Message: "line one\nline two",
+		Hash:    "abc",
+	}
+	msg := s.format(e, cefPromptDenied)
+
+	prefix := "<84>1 2017-01-02T03:04:05Z host duo-bot " + strconv.Itoa(os.Getpid()) + " prompt_denied - "
+	if !strings.HasPrefix(msg, prefix) {
+		t.Errorf("expected an RFC5424 header %q, got %q", prefix, msg)
+	}
+	for _, want := range []string{
+		`CEF:0|Palantir|duo-bot|1.0\|beta|prompt_denied|MFA prompt denied|6|`,
+		"suser=alice ",
+		`cs1Label=key cs1=deploy\=prod `,
+		`msg=line one\nline two `,
+		"cs5Label=auditHash cs5=abc ",
+		"cn1Label=auditSeq cn1=7",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected %q in %q", want, msg)
+		}
+	}
+	if strings.Contains(msg, "\n") {
+		t.Error("message spans lines")
+	}
+}
+
+// collector accepts one TCP connection and reads octet-counted frames off it
+func collector(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	msgs := make(chan string, 100)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil {
+				t.Errorf("bad frame length %q", length)
+				return
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			msgs <- string(msg)
+		}
+	}()
+	return ln.Addr().String(), msgs
+}
+
+func receive(t *testing.T, msgs <-chan string) string {
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a syslog message")
+		return ""
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	addr, msgs := collector(t)
+	s, err := NewSyslogSink(SyslogConfig{Network: "tcp", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Write(Event{Type: EventCheck, Key: "ignored"})
+	s.Write(Event{Type: EventPromptCreated, Key: "first"})
+	s.Write(Event{Type: EventStateTransition, Result: "allowed", Key: "second"})
+
+	if msg := receive(t, msgs); !strings.Contains(msg, "cs1=first ") {
+		t.Errorf("expected the prompt first, got %q", msg)
+	}
+	if msg := receive(t, msgs); !strings.Contains(msg, "cs1=second ") {
+		t.Errorf("expected the approval second, got %q", msg)
+	}
+}
+
+func TestSpillReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spillFile := filepath.Join(dir, "spill")
+
+	// Nothing listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	s := SyslogSink{cfg: SyslogConfig{Network: "tcp", Addr: down, SpillFile: spillFile}, hostname: "host"}
+	if err := s.spill([]string{"one", "two"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.replay(); err == nil {
+		t.Fatal("replayed to a collector that's down")
+	}
+	if msgs, _ := s.readSpill(); len(msgs) != 2 {
+		t.Fatalf("expected both messages to stay spilled, got %v", msgs)
+	}
+
+	addr, received := collector(t)
+	s.cfg.Addr = addr
+	if err := s.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if first, second := receive(t, received), receive(t, received); first != "one" || second != "two" {
+		t.Errorf("expected spilled messages in order, got %q, %q", first, second)
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed once replayed, got %v", err)
+	}
+	s.conn.Close()
+}
+
+func TestDropSpilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := SyslogSink{cfg: SyslogConfig{SpillFile: filepath.Join(dir, "spill")}}
+	// replay read the first two and sent one, the third was spilled while it was sending
+	if err := s.spill([]string{"sent", "unsent", "spilled while sending"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.dropSpilled(1); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := s.readSpill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0] != "unsent" || msgs[1] != "spilled while sending" {
+		t.Errorf("expected only the sent message to be dropped, got %v", msgs)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/palantir/duo-bot/audit"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with the duo-bot audit log",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify [audit log]",
+	Short: "Verify the audit log hasn't been modified or truncated",
+	Long: `Walk the hash chain of the audit log, checking that no entry has been modified, removed or reordered,
+and that the log hasn't been truncated.  Defaults to the audit.file from config.`,
+	// A failed verification isn't a usage error
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("Only one audit log can be verified at a time")
+		}
+
+		path := viper.GetString("audit.file")
+		if len(args) == 1 {
+			path = args[0]
+		}
+		if path == "" {
+			return errors.New("No audit log given, and audit.file not set in config")
+		}
+
+		n, err := audit.Verify(path)
+		if err != nil {
+			return errors.Wrapf(err, "Audit log %s failed verification after %d good entries", path, n)
+		}
+
+		fmt.Printf("Audit log %s verified, %d entries\n", path, n)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/palantir/duo-bot/duotest"
+)
+
+var fakeDuoCmd = &cobra.Command{
+	Use:   "fake-duo",
+	Short: "Run a fake DUO Auth API for local development",
+	Long: `Run a fake of DUO's Auth API, checking requests are signed with duo.ikey and duo.skey, and answering
+each user with the outcome scripted for them in fake_duo.users (or with --user name=outcome).  Outcomes are
+allow, deny, fraud, timeout, waiting_then_allow, bypass and locked_out.  Users with no outcome get
+fake_duo.default, or aren't enrolled if that's unset.
+
+It listens on duo.host, with a self-signed certificate written to duo.ca_file, so the same config runs a
+duo-bot server against it.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log.SetLevel(logLevelFromViper())
+
+		addr, err := cmd.Flags().GetString("addr")
+		if err != nil {
+			return err
+		}
+		if addr == "" {
+			addr = viper.GetString("duo.host")
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.Wrapf(err, "fake DUO needs a host:port to listen on, not '%s'", addr)
+		}
+
+		ikey := viper.GetString("duo.ikey")
+		skey := viper.GetString("duo.skey")
+		if ikey == "" || skey == "" {
+			return errors.New("duo.ikey and duo.skey must be set in config")
+		}
+
+		h := duotest.NewHandler(ikey, skey)
+
+		if def := viper.GetString("fake_duo.default"); def != "" {
+			o, err := duotest.ParseOutcome(def)
+			if err != nil {
+				return errors.Wrap(err, "invalid fake_duo.default")
+			}
+			h.SetDefault(o)
+		}
+		if waits := viper.GetInt("fake_duo.waits"); waits > 0 {
+			h.SetWaits(waits)
+		}
+		h.SetAnswerDelay(viper.GetDuration("fake_duo.answer_delay"))
+
+		users := viper.GetStringMapString("fake_duo.users")
+		flagUsers, err := cmd.Flags().GetStringSlice("user")
+		if err != nil {
+			return err
+		}
+		for _, u := range flagUsers {
+			parts := strings.SplitN(u, "=", 2)
+			if len(parts) != 2 {
+				return errors.Errorf("--user takes name=outcome, not '%s'", u)
+			}
+			users[parts[0]] = parts[1]
+		}
+		for name, outcome := range users {
+			o, err := duotest.ParseOutcome(outcome)
+			if err != nil {
+				return errors.Wrapf(err, "invalid outcome for user %s", name)
+			}
+			h.SetUser(name, o)
+			log.Infof("User %s will %s", name, o)
+		}
+
+		cert, certPEM, err := duotest.SelfSignedCert([]string{host, "localhost", "127.0.0.1"})
+		if err != nil {
+			return errors.Wrap(err, "error generating certificate for fake DUO")
+		}
+		if caFile := viper.GetString("duo.ca_file"); caFile != "" {
+			if err := ioutil.WriteFile(caFile, certPEM, 0644); err != nil {
+				return errors.Wrapf(err, "error writing fake DUO's certificate to %s", caFile)
+			}
+			log.Infof("Wrote fake DUO's certificate to %s", caFile)
+		} else {
+			log.Warn("duo.ca_file not set, duo-bot won't trust fake DUO's self-signed certificate")
+		}
+
+		srv := http.Server{
+			Addr:      addr,
+			Handler:   h,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		log.Infof("Fake DUO listening on %s", addr)
+		return srv.ListenAndServeTLS("", "")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fakeDuoCmd)
+
+	fakeDuoCmd.Flags().StringP("addr", "a", "", "Addr to listen on in host:port form, defaults to duo.host")
+	fakeDuoCmd.Flags().StringSlice("user", nil, "Outcome for a user, as name=outcome.  Can be repeated.")
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/palantir/duo-bot/receipt"
+)
+
+var (
+	verifyJWKS     string
+	verifyIssuer   string
+	verifyKey      string
+	verifyUser     string
+	verifyMetadata []string
+	verifyClient   string
+)
+
+var verifyReceiptCmd = &cobra.Command{
+	Use:   "verify-receipt [receipt]",
+	Short: "Verify a signed approval receipt offline, printing its claims",
+	Long: `Check a receipt from /v1/check was signed by one of duo-bot's receipt keys and hasn't expired, and
+optionally that it's for the given key, user and bound context.  The receipt is read from stdin if it
+isn't given.  The keys are those in --jwks, a file or the URL of duo-bot's /v1/receipts/jwks.json, or
+else the receipts.keys from config.`,
+	// A failed verification isn't a usage error
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("Only one receipt can be verified at a time")
+		}
+
+		var token string
+		if len(args) == 1 {
+			token = args[0]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return errors.Wrap(err, "Error reading receipt from stdin")
+			}
+			token = line
+		}
+		token = strings.TrimSpace(token)
+
+		set, err := verificationKeys()
+		if err != nil {
+			return err
+		}
+		issuer := verifyIssuer
+		if issuer == "" {
+			issuer = receiptIssuer()
+		}
+
+		claims, err := set.Verify(token, issuer)
+		if err != nil {
+			return err
+		}
+		if verifyKey != "" && claims.Key != verifyKey {
+			return errors.Errorf("Receipt is for key '%s', not '%s'", claims.Key, verifyKey)
+		}
+		if verifyUser != "" && claims.Subject != verifyUser {
+			return errors.Errorf("Receipt is for user '%s', not '%s'", claims.Subject, verifyUser)
+		}
+		if len(verifyMetadata) > 0 || verifyClient != "" {
+			if claims.Binding == nil {
+				return errors.New("Receipt isn't bound to any context")
+			}
+			presented := make(map[string]string)
+			for _, kv := range verifyMetadata {
+				parts := strings.SplitN(kv, "=", 2)
+				if len(parts) != 2 {
+					return errors.Errorf("--metadata '%s' isn't FIELD=VALUE", kv)
+				}
+				presented[parts[0]] = parts[1]
+			}
+			if mismatches := claims.Binding.Mismatches(presented, verifyClient); len(mismatches) > 0 {
+				return errors.Errorf("Receipt is for a different %s", strings.Join(mismatches, ", "))
+			}
+		}
+
+		b, err := json.MarshalIndent(claims, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Error printing claims")
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var newReceiptKeyCmd = &cobra.Command{
+	Use:   "new-receipt-key <file>",
+	Short: "Generate a receipt signing key",
+	Long: `Write a new ECDSA P-256 key for signing receipts to the file, which mustn't exist yet.  To rotate keys,
+add the new key last in receipts.keys so it's published, then once verifiers have picked it up, move it
+first so it signs.  Remove the old key once the receipts it signed have expired.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("You must specify exactly one file to write the key to")
+		}
+
+		pem, err := receipt.GenerateKey()
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return errors.Wrap(err, "Error creating key file")
+		}
+		if _, err := f.Write(pem); err != nil {
+			f.Close()
+			return errors.Wrap(err, "Error writing key file")
+		}
+		return errors.Wrap(f.Close(), "Error writing key file")
+	},
+}
+
+// openReceiptSigner returns the receipt signer from config, or nil if receipts aren't enabled
+func openReceiptSigner() (*receipt.Signer, error) {
+	paths := viper.GetStringSlice("receipts.keys")
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	keys, err := receipt.LoadKeys(paths)
+	if err != nil {
+		return nil, err
+	}
+	return receipt.New(receipt.Config{
+		Keys:   keys,
+		Issuer: viper.GetString("receipts.issuer"),
+		TTL:    viper.GetDuration("receipts.ttl"),
+	})
+}
+
+func receiptIssuer() string {
+	if issuer := viper.GetString("receipts.issuer"); issuer != "" {
+		return issuer
+	}
+	return receipt.DefaultIssuer
+}
+
+// verificationKeys returns the keys from --jwks, or the configured receipt keys
+func verificationKeys() (*receipt.JWKS, error) {
+	if verifyJWKS == "" {
+		signer, err := openReceiptSigner()
+		if err != nil {
+			return nil, err
+		}
+		if signer == nil {
+			return nil, errors.New("No --jwks given, and receipts.keys not set in config")
+		}
+		return signer.JWKS(), nil
+	}
+
+	var b []byte
+	var err error
+	if strings.HasPrefix(verifyJWKS, "http://") || strings.HasPrefix(verifyJWKS, "https://") {
+		b, err = fetchJWKS(verifyJWKS)
+	} else {
+		b, err = ioutil.ReadFile(verifyJWKS)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading JWKS from %s", verifyJWKS)
+	}
+	return receipt.ParseJWKS(b)
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("got %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func init() {
+	RootCmd.AddCommand(verifyReceiptCmd)
+	RootCmd.AddCommand(newReceiptKeyCmd)
+
+	verifyReceiptCmd.Flags().StringVar(&verifyJWKS, "jwks", "", "JWKS file or URL to verify with, defaults to receipts.keys from config")
+	verifyReceiptCmd.Flags().StringVar(&verifyIssuer, "issuer", "", "Issuer the receipt must be from, defaults to receipts.issuer from config or duo-bot")
+	verifyReceiptCmd.Flags().StringVar(&verifyKey, "key", "", "Key the receipt must be for")
+	verifyReceiptCmd.Flags().StringVar(&verifyUser, "user", "", "User the receipt must be for")
+	verifyReceiptCmd.Flags().StringArrayVar(&verifyMetadata, "metadata", nil, "FIELD=VALUE of bound metadata the receipt must be for, can be repeated")
+	verifyReceiptCmd.Flags().StringVar(&verifyClient, "client", "", "Client the receipt must be for, if it's bound to one")
+}
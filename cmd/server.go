@@ -20,7 +20,15 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/duoclient"
+	"github.com/palantir/duo-bot/identity"
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/mfa/totp"
+	"github.com/palantir/duo-bot/redact"
 	"github.com/palantir/duo-bot/server"
+	"github.com/palantir/duo-bot/state"
+	"github.com/palantir/duo-bot/tracing"
 )
 
 var serverCmd = &cobra.Command{
@@ -31,10 +39,6 @@ var serverCmd = &cobra.Command{
 		log.SetLevel(logLevelFromViper())
 
 		log.Debug("server called")
-		if log.GetLevel() == log.DebugLevel {
-			cmd.DebugFlags()
-			viper.Debug()
-		}
 
 		serverAddr := viper.GetString("server.addr")
 		if serverAddr == "" {
@@ -56,18 +60,199 @@ var serverCmd = &cobra.Command{
 			log.Fatal("duo.skey not set in config")
 		}
 
+		// From here on, nothing should ever log secrets or passcodes
+		redactor := redact.New([]string{duoSkey}, viper.GetStringSlice("redact.fields"))
+		log.AddHook(redactor)
+
+		if log.GetLevel() == log.DebugLevel {
+			cmd.DebugFlags()
+			// viper.Debug() prints straight to stdout, so route the settings through the redactor instead
+			log.Debugf("Loaded config: %v", viper.AllSettings())
+		}
+
 		log.Debugf("%s %s", viper.Get("server.addr"), version)
 
-		srv, err := server.New(serverAddr, version, duoHost, duoIkey, duoSkey)
+		var auditSinks []audit.Sink
+		if syslogAddr := viper.GetString("audit.syslog.addr"); syslogAddr != "" {
+			sink, err := audit.NewSyslogSink(audit.SyslogConfig{
+				Network:   viper.GetString("audit.syslog.network"),
+				Addr:      syslogAddr,
+				CAFile:    viper.GetString("audit.syslog.ca_file"),
+				Version:   version,
+				Buffer:    viper.GetInt("audit.syslog.buffer"),
+				SpillFile: viper.GetString("audit.syslog.spill_file"),
+			})
+			if err != nil {
+				log.Fatal(errors.Wrap(err, "Error configuring audit syslog"))
+			}
+			auditSinks = append(auditSinks, sink)
+			log.Infof("Sending audit events to syslog at %s", syslogAddr)
+		}
+
+		var auditLog *audit.Log
+		auditFile := viper.GetString("audit.file")
+		if auditFile != "" || len(auditSinks) > 0 {
+			var err error
+			auditLog, err = audit.Open(auditFile, auditSinks...)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if auditFile != "" {
+				log.Infof("Writing audit log to %s", auditFile)
+			}
+		}
 
+		var tracer *tracing.Tracer
+		var exporter *tracing.Exporter
+		if viper.GetBool("tracing.enabled") {
+			endpoint := viper.GetString("tracing.endpoint")
+			if endpoint == "" {
+				endpoint = tracing.DefaultEndpoint
+			}
+			serviceName := viper.GetString("tracing.service_name")
+			if serviceName == "" {
+				serviceName = "duo-bot"
+			}
+			exporter = tracing.NewExporter(endpoint, serviceName, version)
+			tracer = tracing.NewTracer(exporter)
+			log.Infof("Exporting traces to %s", endpoint)
+		}
+
+		var pending *state.PendingStore
+		if pendingFile := viper.GetString("state.pending_file"); pendingFile != "" {
+			var err error
+			pending, err = state.OpenPendingStore(pendingFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Persisting pending async prompts to %s", pendingFile)
+		}
+
+		providers := make(map[string]mfa.Provider)
+		var breakGlass server.BreakGlassPolicy
+		if viper.GetString("totp.store_file") != "" {
+			store, err := openTOTPStore()
+			if err != nil {
+				log.Fatal(err)
+			}
+			providers[totp.Name] = totp.New(store)
+			log.Infof("TOTP provider enabled, with secrets from %s", store.Path())
+
+			breakGlass = server.BreakGlassPolicy{
+				Provider:   totp.Name,
+				Users:      viper.GetStringSlice("totp.break_glass.users"),
+				Namespaces: viper.GetStringSlice("totp.break_glass.namespaces"),
+			}
+		}
+
+		receipts, err := openReceiptSigner()
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Error configuring receipts"))
+		}
+		if receipts != nil {
+			log.Infof("Signing receipts as %s", receipts.Issuer())
+		}
+
+		identities, err := identityMappers()
 		if err != nil {
 			log.Fatal(err)
-		} else {
-			srv.Start()
 		}
+
+		var namespaces []server.Namespace
+		if err := viper.UnmarshalKey("namespaces", &namespaces); err != nil {
+			log.Fatal(errors.Wrap(err, "error reading namespaces from config"))
+		}
+
+		srv, err := server.New(server.Config{
+			Addr:    serverAddr,
+			Version: version,
+			Duo: duoclient.Config{
+				Host:             duoHost,
+				Ikey:             duoIkey,
+				Skey:             duoSkey,
+				Timeout:          viper.GetDuration("duo.timeout"),
+				AuthTimeout:      viper.GetDuration("duo.auth_timeout"),
+				Proxy:            viper.GetString("duo.proxy"),
+				CAFile:           viper.GetString("duo.ca_file"),
+				MaxRetries:       viper.GetInt("duo.max_retries"),
+				BreakerThreshold: viper.GetInt("duo.breaker.threshold"),
+				BreakerCooldown:  viper.GetDuration("duo.breaker.cooldown"),
+			},
+			Providers:       providers,
+			DefaultProvider: viper.GetString("mfa.default_provider"),
+			Namespaces:      namespaces,
+			BreakGlass:      breakGlass,
+			Identities:      identities,
+			DefaultIdentity: viper.GetString("identity.default"),
+
+			FactorPreference: viper.GetStringSlice("mfa.factor_preference"),
+			PasscodeTTL:      viper.GetDuration("sms.passcode_ttl"),
+			PasscodeAttempts: viper.GetInt("sms.max_attempts"),
+
+			ClientHeader:   viper.GetString("server.client_header"),
+			TrustedProxies: viper.GetStringSlice("server.trusted_proxies"),
+			Admins:         viper.GetStringSlice("server.admins"),
+			ConfigFile:     viper.ConfigFileUsed(),
+
+			ProbeInterval:     viper.GetDuration("health.probe_interval"),
+			MaxClockSkew:      viper.GetDuration("health.max_clock_skew"),
+			MaxTrackerBacklog: viper.GetInt("health.max_tracker_backlog"),
+
+			Redactor: redactor,
+			AuditLog: auditLog,
+			Tracer:   tracer,
+			Receipts: receipts,
+
+			ShutdownGrace: viper.GetDuration("server.shutdown_grace"),
+			PollWorkers:   viper.GetInt("duo.poll_workers"),
+			Pending:       pending,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		startErr := srv.Start()
+
+		// Trackers are done by now, so nothing else will be audited or traced
+		if auditLog != nil {
+			if err := auditLog.Close(); err != nil {
+				log.Error(errors.Wrap(err, "Error closing audit log"))
+			}
+		}
+		if exporter != nil {
+			exporter.Shutdown()
+		}
+		if startErr != nil {
+			log.Fatal(startErr)
+		}
+		log.Info("Shut down")
 	},
 }
 
+// identityMappers builds each of the identity mappings under identity.mappings, by name
+func identityMappers() (map[string]*identity.Mapper, error) {
+	mappers := make(map[string]*identity.Mapper)
+	for name := range viper.GetStringMap("identity.mappings") {
+		prefix := "identity.mappings." + name + "."
+
+		var rules []identity.Rule
+		if err := viper.UnmarshalKey(prefix+"rules", &rules); err != nil {
+			return nil, errors.Wrapf(err, "error reading rules of identity mapping %s from config", name)
+		}
+		m, err := identity.New(identity.Config{
+			File:           viper.GetString(prefix + "file"),
+			Rules:          rules,
+			Case:           viper.GetString(prefix + "case"),
+			ReloadInterval: viper.GetDuration(prefix + "reload_interval"),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error configuring identity mapping %s", name)
+		}
+		mappers[name] = m
+	}
+	return mappers, nil
+}
+
 func init() {
 	RootCmd.AddCommand(serverCmd)
 
@@ -0,0 +1,140 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/palantir/duo-bot/mfa/totp"
+	"github.com/palantir/duo-bot/server"
+)
+
+const defaultTOTPIssuer = "duo-bot"
+
+var (
+	totpReplace   bool
+	totpNamespace string
+)
+
+var totpCmd = &cobra.Command{
+	Use:   "totp",
+	Short: "Manage the local TOTP break-glass provider",
+}
+
+var totpEnrollCmd = &cobra.Command{
+	Use:   "enroll <user>",
+	Short: "Enroll a user for TOTP, printing the otpauth URI to add to their authenticator app",
+	Long: `Generate a TOTP secret for the user, save it in the encrypted totp.store_file, and print the
+otpauth URI for them to add to their authenticator app (usually by turning it into a QR code).
+The URI contains the secret, so hand it over securely.  The user is mapped to their DUO username
+with the --namespace's identity mapping, or identity.default, like prompts are.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("You must specify exactly one user to enroll")
+		}
+		user, err := totpUser(args[0], totpNamespace)
+		if err != nil {
+			return err
+		}
+
+		store, err := openTOTPStore()
+		if err != nil {
+			return err
+		}
+
+		secret, err := store.Enroll(user, totpReplace)
+		if err != nil {
+			return errors.Wrapf(err, "Error enrolling %s", user)
+		}
+
+		issuer := viper.GetString("totp.issuer")
+		if issuer == "" {
+			issuer = defaultTOTPIssuer
+		}
+		fmt.Println(totp.URI(issuer, user, secret))
+		return nil
+	},
+}
+
+// totpUser maps user to the name prompts for keys in namespace look their secret up by
+func totpUser(user string, namespace string) (string, error) {
+	mapping := viper.GetString("identity.default")
+	if namespace != "" {
+		var namespaces []server.Namespace
+		if err := viper.UnmarshalKey("namespaces", &namespaces); err != nil {
+			return "", errors.Wrap(err, "error reading namespaces from config")
+		}
+		found := false
+		for _, ns := range namespaces {
+			if ns.Name == namespace {
+				found = true
+				if ns.Identity != "" {
+					mapping = ns.Identity
+				}
+			}
+		}
+		if !found {
+			return "", errors.Errorf("Unknown namespace %s", namespace)
+		}
+	}
+	if mapping == "" {
+		return user, nil
+	}
+
+	identities, err := identityMappers()
+	if err != nil {
+		return "", err
+	}
+	m, ok := identities[mapping]
+	if !ok {
+		return "", errors.Errorf("Unknown identity mapping %s", mapping)
+	}
+	mapped, err := m.Map(user)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error mapping %s with %s", user, mapping)
+	}
+	return mapped, nil
+}
+
+// openTOTPStore opens the TOTP store from config
+func openTOTPStore() (*totp.Store, error) {
+	path := viper.GetString("totp.store_file")
+	if path == "" {
+		return nil, errors.New("totp.store_file not set in config")
+	}
+	keyFile := viper.GetString("totp.key_file")
+	if keyFile == "" {
+		return nil, errors.New("totp.key_file not set in config")
+	}
+
+	key, err := totp.LoadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return totp.NewStore(path, key)
+}
+
+func init() {
+	RootCmd.AddCommand(totpCmd)
+	totpCmd.AddCommand(totpEnrollCmd)
+
+	totpEnrollCmd.Flags().BoolVar(&totpReplace, "replace", false, "Replace the user's secret if they're already enrolled")
+	totpEnrollCmd.Flags().StringVar(&totpNamespace, "namespace", "", "Map the user with this namespace's identity mapping instead of identity.default")
+}
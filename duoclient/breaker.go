@@ -0,0 +1,123 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package duoclient
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BreakerState is the state of the circuit breaker in front of DUO
+type BreakerState int
+
+const (
+	// BreakerClosed means calls go through to DUO as normal
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means DUO has been failing, and calls fail fast without trying it
+	BreakerOpen
+	// BreakerHalfOpen means the cooldown is over, and a single call is let through to see if DUO is back
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker opens after threshold calls in a row fail, and lets a trial call through once cooldown is over
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// Whether the one call allowed while half open is still out
+	trialOut bool
+}
+
+// allow returns whether a call should go through to DUO
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trialOut = true
+		return true
+	case BreakerHalfOpen:
+		if b.trialOut {
+			return false
+		}
+		b.trialOut = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerClosed {
+		log.Info("DUO is answering again, closing circuit breaker")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trialOut = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trialOut = false
+
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		log.Warnf("%d calls to DUO in a row failed, opening circuit breaker for %v", b.failures, b.cooldown)
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// neither records a call that said nothing about whether DUO is up, like one we cancelled
+func (b *breaker) neither() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialOut = false
+}
+
+func (b *breaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,484 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package duoclient is a client for DUO's Auth API that copes with DUO being slow, rate limiting us or down:
+// calls time out, idempotent calls are retried with jittered back-off, and a circuit breaker fails calls fast
+// while DUO is down.  Results are the vendored authapi's types, so it's a drop-in for authapi.AuthApi.
+package duoclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/duosecurity/duo_api_golang/authapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTimeout          = 10 * time.Second
+	defaultAuthTimeout      = 90 * time.Second
+	defaultMaxRetries       = 3
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+
+	// Retries back off from here, doubling each time
+	baseRetryBackoff = 200 * time.Millisecond
+	maxRetryBackoff  = 5 * time.Second
+)
+
+// Config is everything needed to build a Client
+type Config struct {
+	Host      string
+	Ikey      string
+	Skey      string
+	UserAgent string
+
+	// Timeout for calls that should return straight away, defaults to defaultTimeout
+	Timeout time.Duration
+	// Timeout for blocking auth and auth_status calls, which wait on the user, defaults to defaultAuthTimeout
+	AuthTimeout time.Duration
+
+	// URL of an HTTP proxy to reach DUO through, defaults to the proxy set in the environment
+	Proxy string
+	// PEM bundle of CAs to trust for DUO's certificate instead of the ones duoapi pins it to, e.g. for a fake DUO
+	CAFile string
+
+	// How many times idempotent calls are retried, defaults to defaultMaxRetries.  Negative disables retries.
+	MaxRetries int
+	// How many calls in a row have to fail to open the circuit breaker, defaults to defaultBreakerThreshold
+	BreakerThreshold int
+	// How long the circuit breaker stays open before letting a call through to try DUO again, defaults to defaultBreakerCooldown
+	BreakerCooldown time.Duration
+
+	// Optional, told about every call made
+	Observer Observer
+}
+
+// An Observer is told about every call made to DUO, e.g. to record metrics or trace it
+type Observer interface {
+	// Observe is called as a call to endpoint starts, returning a func to call with how it went.
+	// stat is nil if DUO didn't answer.
+	Observe(ctx context.Context, endpoint string) func(stat *authapi.StatResult, err error)
+}
+
+// A Client calls DUO's Auth API
+type Client struct {
+	host        string
+	ikey        string
+	skey        string
+	userAgent   string
+	timeout     time.Duration
+	authTimeout time.Duration
+	maxRetries  int
+	http        *http.Client
+	breaker     *breaker
+	observer    Observer
+}
+
+// RateLimitCode is DUO's error code for "too many requests", in the stat of a response DUO rate limited
+const RateLimitCode = 42901
+
+// ErrCircuitOpen is returned without calling DUO while the circuit breaker is open
+var ErrCircuitOpen = errors.New("DUO is unavailable, not calling it until it recovers")
+
+// unavailableError is DUO being down or unreachable, as opposed to DUO answering with an error
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+// IsUnavailable returns whether err means DUO couldn't be reached or is down, so it's worth trying again later
+func IsUnavailable(err error) bool {
+	cause := errors.Cause(err)
+	if cause == ErrCircuitOpen {
+		return true
+	}
+	_, ok := cause.(*unavailableError)
+	return ok
+}
+
+// New returns a Client for cfg
+func New(cfg Config) (*Client, error) {
+	if cfg.Host == "" || cfg.Ikey == "" || cfg.Skey == "" {
+		return nil, errors.New("DUO host, ikey and skey must all be set")
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: duoRoots()},
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid DUO proxy URL '%s'", cfg.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading DUO CA bundle %s", cfg.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in DUO CA bundle %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	c := Client{
+		host:        cfg.Host,
+		ikey:        cfg.Ikey,
+		skey:        cfg.Skey,
+		userAgent:   cfg.UserAgent,
+		timeout:     cfg.Timeout,
+		authTimeout: cfg.AuthTimeout,
+		maxRetries:  cfg.MaxRetries,
+		http:        &http.Client{Transport: transport},
+		observer:    cfg.Observer,
+		breaker: &breaker{
+			threshold: cfg.BreakerThreshold,
+			cooldown:  cfg.BreakerCooldown,
+		},
+	}
+
+	if c.timeout <= 0 {
+		c.timeout = defaultTimeout
+	}
+	if c.authTimeout <= 0 {
+		c.authTimeout = defaultAuthTimeout
+	}
+	if c.maxRetries < 0 {
+		c.maxRetries = 0
+	} else if c.maxRetries == 0 {
+		c.maxRetries = defaultMaxRetries
+	}
+	if c.breaker.threshold <= 0 {
+		c.breaker.threshold = defaultBreakerThreshold
+	}
+	if c.breaker.cooldown <= 0 {
+		c.breaker.cooldown = defaultBreakerCooldown
+	}
+
+	return &c, nil
+}
+
+// Breaker returns the state of the circuit breaker in front of DUO
+func (c *Client) Breaker() BreakerState {
+	return c.breaker.current()
+}
+
+// request is a single call to the API, however many attempts it takes
+type request struct {
+	method  string
+	path    string
+	params  url.Values
+	signed  bool
+	timeout time.Duration
+	// Whether it's safe to send again after it may have reached DUO
+	idempotent bool
+}
+
+// Ping calls DUO's /ping, which needs no credentials
+func (c *Client) Ping(ctx context.Context) (*authapi.PingResult, error) {
+	done := c.observe(ctx, "ping")
+	var res authapi.PingResult
+	err := c.call(ctx, request{method: "GET", path: "/auth/v2/ping", timeout: c.timeout, idempotent: true}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+// Check calls DUO's /check, which checks our credentials
+func (c *Client) Check(ctx context.Context) (*authapi.CheckResult, error) {
+	done := c.observe(ctx, "check")
+	var res authapi.CheckResult
+	err := c.call(ctx, request{method: "GET", path: "/auth/v2/check", signed: true, timeout: c.timeout, idempotent: true}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+// Preauth calls DUO's /preauth, with the vendored authapi's Preauth* options
+func (c *Client) Preauth(ctx context.Context, options ...func(*url.Values)) (*authapi.PreauthResult, error) {
+	params := url.Values{}
+	for _, o := range options {
+		o(&params)
+	}
+
+	done := c.observe(ctx, "preauth")
+	var res authapi.PreauthResult
+	err := c.call(ctx, request{method: "POST", path: "/auth/v2/preauth", params: params, signed: true, timeout: c.timeout, idempotent: true}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+// Auth calls DUO's /auth, with the vendored authapi's Auth* options.  It's never retried once it may have
+// reached DUO, since that could prompt the user twice.
+func (c *Client) Auth(ctx context.Context, factor string, options ...func(*url.Values)) (*authapi.AuthResult, error) {
+	params := url.Values{}
+	for _, o := range options {
+		o(&params)
+	}
+	params.Set("factor", factor)
+
+	// Unless it's async, auth blocks until the user answers
+	timeout := c.authTimeout
+	if _, ok := params["async"]; ok {
+		timeout = c.timeout
+	}
+
+	done := c.observe(ctx, "auth")
+	var res authapi.AuthResult
+	err := c.call(ctx, request{method: "POST", path: "/auth/v2/auth", params: params, signed: true, timeout: timeout}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+// AuthStatus calls DUO's /auth_status, which blocks until the transaction's status changes
+func (c *Client) AuthStatus(ctx context.Context, txid string) (*authapi.AuthStatusResult, error) {
+	params := url.Values{}
+	params.Set("txid", txid)
+
+	done := c.observe(ctx, "auth_status")
+	var res authapi.AuthStatusResult
+	err := c.call(ctx, request{method: "GET", path: "/auth/v2/auth_status", params: params, signed: true, timeout: c.authTimeout, idempotent: true}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+// Enroll calls DUO's /enroll, with the vendored authapi's Enroll* options.  It's never retried once it may have
+// reached DUO, since that could create the user twice.
+func (c *Client) Enroll(ctx context.Context, options ...func(*url.Values)) (*authapi.EnrollResult, error) {
+	params := url.Values{}
+	for _, o := range options {
+		o(&params)
+	}
+
+	done := c.observe(ctx, "enroll")
+	var res authapi.EnrollResult
+	err := c.call(ctx, request{method: "POST", path: "/auth/v2/enroll", params: params, signed: true, timeout: c.timeout}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+// EnrollStatus calls DUO's /enroll_status, which says whether the user has activated an enrollment yet
+func (c *Client) EnrollStatus(ctx context.Context, userID string, activationCode string) (*authapi.EnrollStatusResult, error) {
+	params := url.Values{}
+	params.Set("user_id", userID)
+	params.Set("activation_code", activationCode)
+
+	done := c.observe(ctx, "enroll_status")
+	var res authapi.EnrollStatusResult
+	err := c.call(ctx, request{method: "POST", path: "/auth/v2/enroll_status", params: params, signed: true, timeout: c.timeout, idempotent: true}, &res)
+	if err != nil {
+		done(nil, err)
+		return nil, err
+	}
+	done(&res.StatResult, nil)
+	return &res, nil
+}
+
+func (c *Client) observe(ctx context.Context, endpoint string) func(*authapi.StatResult, error) {
+	if c.observer == nil {
+		return func(*authapi.StatResult, error) {}
+	}
+	return c.observer.Observe(ctx, endpoint)
+}
+
+// call makes r, retrying it if that's safe, and decodes DUO's answer into res.  However many attempts it takes,
+// it counts as a single call to the circuit breaker.
+func (c *Client) call(ctx context.Context, r request, res interface{}) error {
+	if !c.breaker.allow() {
+		return ErrCircuitOpen
+	}
+
+	body, err := c.attempts(ctx, r)
+	switch {
+	case ctx.Err() != nil:
+		// We gave up, which says nothing about DUO
+		c.breaker.neither()
+		return errors.Wrapf(ctx.Err(), "calling DUO %s", r.path)
+	case err != nil:
+		c.breaker.failure()
+		return &unavailableError{err: err}
+	}
+
+	c.breaker.success()
+	return decode(r.path, body, res)
+}
+
+// attempts makes r until DUO answers it, or it's failed and isn't safe or worth trying again
+func (c *Client) attempts(ctx context.Context, r request) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, status, retryAfter, err := c.once(ctx, r)
+
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err != nil:
+		case status >= 500:
+			err = errors.Errorf("DUO %s returned HTTP %d", r.path, status)
+		case status == http.StatusTooManyRequests:
+			// DUO's up, just busy.  The request wasn't processed, so it's always safe to send again.
+			if attempt >= c.maxRetries {
+				// Out of retries, let the caller see DUO's rate limit error and back off itself
+				return body, nil
+			}
+			log.Debugf("Rate limited by DUO %s, retrying", r.path)
+			if !sleep(ctx, retryWait(attempt, retryAfter)) {
+				return nil, ctx.Err()
+			}
+			continue
+		default:
+			return body, nil
+		}
+
+		// Only a request DUO can't have acted on twice is safe to send again
+		if !r.idempotent || attempt >= c.maxRetries {
+			return nil, err
+		}
+
+		log.Debug(errors.Wrapf(err, "Retrying DUO %s", r.path))
+		if !sleep(ctx, retryWait(attempt, 0)) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// once makes a single attempt at r, returning the body, status and any Retry-After DUO sent
+func (c *Client) once(ctx context.Context, r request) ([]byte, int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   c.host,
+		Path:   r.path,
+	}
+
+	var body string
+	if r.method == "GET" {
+		u.RawQuery = r.params.Encode()
+	} else {
+		body = r.params.Encode()
+	}
+
+	req, err := http.NewRequest(r.method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, 0, 0, errors.Wrapf(err, "error building request to DUO %s", r.path)
+	}
+	req = req.WithContext(ctx)
+
+	if r.method != "GET" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if r.signed {
+		date, auth, err := c.sign(r.method, r.path, r.params)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		req.Header.Set("Date", date)
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, 0, errors.Wrapf(err, "error calling DUO %s", r.path)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, 0, errors.Wrapf(err, "error reading response from DUO %s", r.path)
+	}
+
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+
+	return b, resp.StatusCode, retryAfter, nil
+}
+
+func decode(path string, body []byte, res interface{}) error {
+	return errors.Wrapf(json.Unmarshal(body, res), "error parsing response from DUO %s", path)
+}
+
+// retryWait is how long to wait before retry number attempt+1: what DUO asked for, or exponential back-off with full jitter
+func retryWait(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	backoff := baseRetryBackoff << uint(attempt)
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// sleep waits for d, returning false if ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
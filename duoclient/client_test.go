@@ -0,0 +1,213 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package duoclient_test
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/duosecurity/duo_api_golang/authapi"
+
+	"github.com/palantir/duo-bot/duoclient"
+	"github.com/palantir/duo-bot/duotest"
+)
+
+func fakeDuo(t *testing.T) *duotest.Server {
+	fake, err := duotest.NewServer("ikey", "skey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func newClient(t *testing.T, cfg duoclient.Config) *duoclient.Client {
+	c, err := duoclient.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// The fake checks signatures itself, from DUO's documentation, rather than with duoapi
+func TestSigned(t *testing.T) {
+	fake := fakeDuo(t)
+	fake.SetUser("alice b+c@example.com/x", duotest.Allow)
+	c := newClient(t, fake.ClientConfig())
+	ctx := context.Background()
+
+	if res, err := c.Check(ctx); err != nil || res.Stat != "OK" {
+		t.Fatalf("signed GET was refused: %+v, %v", res, err)
+	}
+
+	res, err := c.Preauth(ctx, authapi.PreauthUsername("alice b+c@example.com/x"))
+	if err != nil || res.Stat != "OK" || res.Response.Result != "auth" {
+		t.Fatalf("signed POST was refused: %+v, %v", res, err)
+	}
+
+	auth, err := c.Auth(ctx, "push", authapi.AuthUsername("alice b+c@example.com/x"), authapi.AuthAsync())
+	if err != nil || auth.Stat != "OK" {
+		t.Fatalf("signed async auth was refused: %+v, %v", auth, err)
+	}
+	status, err := c.AuthStatus(ctx, auth.Response.Txid)
+	if err != nil || status.Stat != "OK" || status.Response.Result != "allow" {
+		t.Fatalf("expected auth_status to allow, got %+v, %v", status, err)
+	}
+
+	cfg := fake.ClientConfig()
+	cfg.Skey = "wrong"
+	res, err = newClient(t, cfg).Preauth(ctx, authapi.PreauthUsername("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stat != "FAIL" || res.Code == nil || *res.Code != 40103 {
+		t.Errorf("expected a request signed with the wrong skey to be refused, got %+v", res)
+	}
+}
+
+// Without a CA file, DUO's certificate has to chain to one of the CAs duoapi pins
+func TestPinnedRoots(t *testing.T) {
+	fake := fakeDuo(t)
+	cfg := fake.ClientConfig()
+	cfg.CAFile = ""
+	cfg.MaxRetries = -1
+
+	_, err := newClient(t, cfg).Check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error calling a DUO that isn't pinned, got %v", err)
+	}
+	if !duoclient.IsUnavailable(err) {
+		t.Errorf("expected DUO to count as unavailable, got %v", err)
+	}
+}
+
+// flaky serves handler over TLS, returning a config trusting it and a count of the requests made
+func flaky(t *testing.T, handler func(n int32, w http.ResponseWriter)) (duoclient.Config, *int32) {
+	var n int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(atomic.AddInt32(&n, 1), w)
+	}))
+	t.Cleanup(srv.Close)
+
+	f, err := ioutil.TempFile("", "duoclient-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	return duoclient.Config{
+		Host:   strings.TrimPrefix(srv.URL, "https://"),
+		Ikey:   "ikey",
+		Skey:   "skey",
+		CAFile: f.Name(),
+	}, &n
+}
+
+func TestBreakerCountsCalls(t *testing.T) {
+	cfg, requests := flaky(t, func(n int32, w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	cfg.MaxRetries = 2
+	cfg.BreakerThreshold = 2
+	c := newClient(t, cfg)
+	ctx := context.Background()
+
+	if _, err := c.Check(ctx); !duoclient.IsUnavailable(err) {
+		t.Fatalf("expected DUO to be unavailable, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Errorf("expected a try and 2 retries, got %d requests", n)
+	}
+	if state := c.Breaker(); state != duoclient.BreakerClosed {
+		t.Errorf("expected the retried call to count as one failure, breaker is %v", state)
+	}
+
+	c.Check(ctx)
+	if state := c.Breaker(); state != duoclient.BreakerOpen {
+		t.Fatalf("expected the breaker to open after 2 failed calls, it's %v", state)
+	}
+	if _, err := c.Check(ctx); err != duoclient.ErrCircuitOpen {
+		t.Errorf("expected calls to fail fast while the breaker's open, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 6 {
+		t.Errorf("expected no requests while the breaker's open, got %d in all", n)
+	}
+}
+
+func TestNotRetried(t *testing.T) {
+	cfg, requests := flaky(t, func(n int32, w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	c := newClient(t, cfg)
+
+	if _, err := c.Auth(context.Background(), "push", authapi.AuthUsername("alice")); !duoclient.IsUnavailable(err) {
+		t.Fatalf("expected DUO to be unavailable, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("expected auth not to be retried, it was sent %d times", n)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	rateLimited := `{"stat": "FAIL", "code": 42901, "message": "Too Many Requests"}`
+
+	cfg, requests := flaky(t, func(n int32, w http.ResponseWriter) {
+		if n == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(rateLimited))
+			return
+		}
+		w.Write([]byte(`{"stat": "OK", "response": {"time": 1}}`))
+	})
+	res, err := newClient(t, cfg).Check(context.Background())
+	if err != nil || res.Stat != "OK" {
+		t.Fatalf("expected the rate limited call to be retried, got %+v, %v", res, err)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+
+	// Even auth is sent again, DUO didn't act on it
+	cfg, requests = flaky(t, func(n int32, w http.ResponseWriter) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(rateLimited))
+	})
+	cfg.MaxRetries = 1
+	c := newClient(t, cfg)
+	auth, err := c.Auth(context.Background(), "push", authapi.AuthUsername("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Stat != "FAIL" || auth.Code == nil || *auth.Code != duoclient.RateLimitCode {
+		t.Errorf("expected DUO's rate limit error once out of retries, got %+v", auth)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("expected a try and a retry, got %d requests", n)
+	}
+	if state := c.Breaker(); state != duoclient.BreakerClosed {
+		t.Errorf("expected rate limiting not to count against DUO, breaker is %v", state)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package duoclient
+
+import (
+	"net/http"
+	"net/url"
+
+	duoapi "github.com/duosecurity/duo_api_golang"
+	"github.com/pkg/errors"
+)
+
+// errSigned stops duoapi sending a request once it's signed it
+var errSigned = errors.New("request signed, not sending it")
+
+// sign returns the Date and Authorization headers for a call to path with params, as signed by the vendored duoapi.
+// duoapi only signs a request as it sends it, so it's handed a proxy that keeps the signed request and stops it there.
+func (c *Client) sign(method string, path string, params url.Values) (string, string, error) {
+	var signed *http.Request
+	api := duoapi.NewDuoApi(c.ikey, c.skey, c.host, c.userAgent, duoapi.SetProxy(func(r *http.Request) (*url.URL, error) {
+		signed = r
+		return nil, errSigned
+	}))
+
+	// duoapi sorts the values it signs in place, so give it its own copy
+	copied := make(url.Values, len(params))
+	for key, vals := range params {
+		copied[key] = append([]string(nil), vals...)
+	}
+
+	if _, _, err := api.SignedCall(method, path, copied); signed == nil {
+		return "", "", errors.Wrapf(err, "error signing request to DUO %s", path)
+	}
+	return signed.Header.Get("Date"), signed.Header.Get("Authorization"), nil
+}
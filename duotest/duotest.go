@@ -0,0 +1,523 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package duotest is a fake of the parts of DUO's Auth API duo-bot uses, for local development and tests.
+// It checks requests are signed like DUO does, and answers each user with a scripted outcome.
+package duotest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome is how a user answers every prompt
+type Outcome string
+
+const (
+	// Allow approves the prompt
+	Allow Outcome = "allow"
+	// Deny refuses the prompt
+	Deny Outcome = "deny"
+	// Fraud refuses the prompt and reports it as fraudulent
+	Fraud Outcome = "fraud"
+	// Timeout never answers, until DUO gives up
+	Timeout Outcome = "timeout"
+	// WaitingThenAllow takes a while to answer, then approves the prompt
+	WaitingThenAllow Outcome = "waiting_then_allow"
+	// Bypass is a user DUO lets through without prompting
+	Bypass Outcome = "bypass"
+	// LockedOut is a user DUO won't let through at all
+	LockedOut Outcome = "locked_out"
+)
+
+// ParseOutcome returns the Outcome named s
+func ParseOutcome(s string) (Outcome, error) {
+	switch o := Outcome(s); o {
+	case Allow, Deny, Fraud, Timeout, WaitingThenAllow, Bypass, LockedOut:
+		return o, nil
+	default:
+		return "", fmt.Errorf("unknown outcome '%s', must be one of allow, deny, fraud, timeout, waiting_then_allow, bypass or locked_out", s)
+	}
+}
+
+const (
+	// DefaultPasscode is the passcode every user accepts, unless told otherwise
+	DefaultPasscode = "123456"
+	// DefaultWaits is how many times auth_status answers waiting before a slow outcome is decided
+	DefaultWaits = 2
+
+	// DUO's error codes for the failures we fake
+	codeInvalidParams    = 40002
+	codeInvalidSignature = 40103
+	codeInvalidIkey      = 40101
+)
+
+// User is a user the fake knows about
+type User struct {
+	Outcome  Outcome
+	Passcode string
+}
+
+// Request is a call made to the fake, for tests to check what duo-bot sent
+type Request struct {
+	Method string
+	Path   string
+	Params url.Values
+}
+
+// txn is an async auth, how and when its user answers, and how many times it's been polled
+type txn struct {
+	// Decided when the prompt's sent, so scripting the user again only changes later prompts
+	outcome  Outcome
+	answerAt time.Time
+	polls    int
+}
+
+// enrollment is a device waiting to be activated, and how many times its status has been checked
+type enrollment struct {
+	user   string
+	userID string
+	polls  int
+}
+
+// Handler is the fake Auth API.  It's safe for concurrent use.
+type Handler struct {
+	ikey string
+	skey string
+
+	mu sync.Mutex
+	// Outcome for users not in users, if empty they aren't enrolled
+	def   Outcome
+	users map[string]User
+	waits int
+	// How long users take to answer a push or call
+	answerDelay time.Duration
+	txns        map[string]*txn
+	// By activation code
+	enrollments map[string]*enrollment
+	requests    []Request
+}
+
+// NewHandler returns a fake Auth API only accepting requests signed with ikey and skey
+func NewHandler(ikey string, skey string) *Handler {
+	return &Handler{
+		ikey:  ikey,
+		skey:  skey,
+		users: make(map[string]User),
+		waits: DefaultWaits,
+		txns:  make(map[string]*txn),
+
+		enrollments: make(map[string]*enrollment),
+	}
+}
+
+// SetUser scripts how username answers every prompt
+func (h *Handler) SetUser(username string, outcome Outcome) {
+	h.SetUserPasscode(username, outcome, DefaultPasscode)
+}
+
+// SetUserPasscode scripts how username answers every prompt, and the passcode they accept
+func (h *Handler) SetUserPasscode(username string, outcome Outcome, passcode string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users[username] = User{Outcome: outcome, Passcode: passcode}
+}
+
+// SetDefault sets the outcome for any user not set with SetUser.  By default they aren't enrolled.
+func (h *Handler) SetDefault(outcome Outcome) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.def = outcome
+}
+
+// SetWaits sets how many times auth_status answers waiting before a slow outcome is decided
+func (h *Handler) SetWaits(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.waits = n
+}
+
+// SetAnswerDelay sets how long users take to answer a push or call.  Like DUO, a blocking auth and auth_status
+// don't return until the user has answered, so this is how long they tie up the caller for.
+func (h *Handler) SetAnswerDelay(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.answerDelay = d
+}
+
+// Requests returns every request made so far, oldest first
+func (h *Handler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Request(nil), h.requests...)
+}
+
+func (h *Handler) user(username string) (User, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	u, ok := h.users[username]
+	if !ok && h.def != "" {
+		return User{Outcome: h.def, Passcode: DefaultPasscode}, true
+	}
+	return u, ok
+}
+
+// ServeHTTP answers a call to the Auth API
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", err.Error())
+		return
+	}
+
+	// DUO signs the query string for GETs and the body for everything else, never both
+	params := r.PostForm
+	if r.Method == "GET" {
+		params = r.URL.Query()
+	}
+
+	h.mu.Lock()
+	h.requests = append(h.requests, Request{Method: r.Method, Path: r.URL.Path, Params: params})
+	h.mu.Unlock()
+
+	if r.URL.Path == "/auth/v2/ping" {
+		writeOK(w, map[string]interface{}{"time": time.Now().Unix()})
+		return
+	}
+
+	if !h.verify(w, r, params) {
+		return
+	}
+
+	switch r.URL.Path {
+	case "/auth/v2/check":
+		writeOK(w, map[string]interface{}{"time": time.Now().Unix()})
+	case "/auth/v2/preauth":
+		h.preauth(w, params)
+	case "/auth/v2/auth":
+		h.auth(w, r, params)
+	case "/auth/v2/auth_status":
+		h.authStatus(w, r, params)
+	case "/auth/v2/enroll":
+		h.enroll(w, params)
+	case "/auth/v2/enroll_status":
+		h.enrollStatus(w, params)
+	default:
+		writeFail(w, http.StatusNotFound, 40400, "Resource not found", r.URL.Path)
+	}
+}
+
+// verify checks r is signed with our ikey and skey, failing it if it isn't
+func (h *Handler) verify(w http.ResponseWriter, r *http.Request, params url.Values) bool {
+	ikey, sig, ok := r.BasicAuth()
+	if !ok {
+		writeFail(w, http.StatusUnauthorized, codeInvalidSignature, "Invalid signature in request credentials", "")
+		return false
+	}
+	if ikey != h.ikey {
+		writeFail(w, http.StatusUnauthorized, codeInvalidIkey, "Invalid integration key in request credentials", "")
+		return false
+	}
+
+	date := r.Header.Get("Date")
+	mac := hmac.New(sha1.New, []byte(h.skey))
+	_, _ = mac.Write([]byte(canonicalRequest(date, r.Method, r.Host, r.URL.Path, params)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if date == "" || !hmac.Equal([]byte(sig), []byte(want)) {
+		writeFail(w, http.StatusUnauthorized, codeInvalidSignature, "Invalid signature in request credentials", "")
+		return false
+	}
+
+	return true
+}
+
+// canonicalRequest is the string DUO's docs say a v2 signature is the HMAC-SHA1 of: the date, the upper case method,
+// the lower case host, the path and the parameters, one per line.  The parameters are sorted by name, RFC 3986
+// percent encoded and joined with &.  It's written from the docs rather than shared with any client, so it catches
+// a client signing requests wrongly.
+func canonicalRequest(date string, method string, host string, path string, params url.Values) string {
+	var pairs []string
+	for name, vals := range params {
+		for _, val := range vals {
+			pairs = append(pairs, percentEncode(name)+"="+percentEncode(val))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join([]string{
+		date,
+		strings.ToUpper(method),
+		strings.ToLower(host),
+		path,
+		strings.Join(pairs, "&"),
+	}, "\n")
+}
+
+// percentEncode escapes everything but RFC 3986's unreserved characters, with upper case hex
+func percentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (h *Handler) preauth(w http.ResponseWriter, params url.Values) {
+	username := params.Get("username")
+	if username == "" {
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", "username")
+		return
+	}
+
+	u, ok := h.user(username)
+	switch {
+	case !ok:
+		writeOK(w, map[string]interface{}{
+			"result":            "enroll",
+			"status_msg":        "Enroll an authentication device to proceed",
+			"enroll_portal_url": "https://fake-duo.example.com/portal",
+		})
+		return
+	case u.Outcome == Bypass:
+		writeOK(w, map[string]interface{}{"result": "allow", "status_msg": "Allowing unknown user"})
+		return
+	case u.Outcome == LockedOut:
+		writeOK(w, map[string]interface{}{"result": "deny", "status_msg": "Your account is disabled"})
+		return
+	}
+
+	writeOK(w, map[string]interface{}{
+		"result":     "auth",
+		"status_msg": "Account is active",
+		"devices": []map[string]interface{}{{
+			"device":       "DPFAKE0000000000000",
+			"type":         "phone",
+			"name":         "Fake phone",
+			"number":       "XXX-XXX-0000",
+			"capabilities": []string{"auto", "push", "sms", "phone", "mobile_otp"},
+		}},
+	})
+}
+
+func (h *Handler) auth(w http.ResponseWriter, r *http.Request, params url.Values) {
+	username := params.Get("username")
+	u, known := h.user(username)
+	if !known {
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", "username")
+		return
+	}
+
+	factor := params.Get("factor")
+	switch factor {
+	case "passcode":
+		if params.Get("passcode") == u.Passcode {
+			writeOK(w, answer(Allow))
+		} else {
+			writeOK(w, map[string]interface{}{"result": "deny", "status": "deny", "status_msg": "Incorrect passcode. Please try again."})
+		}
+		return
+	case "push", "phone", "sms", "auto":
+	default:
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", "factor")
+		return
+	}
+
+	// sms only sends passcodes, it never authenticates anyone by itself
+	if factor == "sms" {
+		writeOK(w, map[string]interface{}{"result": "deny", "status": "sent", "status_msg": "New SMS passcodes sent."})
+		return
+	}
+
+	h.mu.Lock()
+	answerAt := time.Now().Add(h.answerDelay)
+	h.mu.Unlock()
+
+	if params.Get("async") != "" {
+		id := newTxid()
+		h.mu.Lock()
+		h.txns[id] = &txn{outcome: u.Outcome, answerAt: answerAt}
+		h.mu.Unlock()
+		writeOK(w, map[string]interface{}{"txid": id})
+		return
+	}
+
+	if !waitUntil(r, answerAt) {
+		return
+	}
+	writeOK(w, answer(u.Outcome))
+}
+
+// authStatus answers once the user has, like DUO's, which long-polls until the status changes
+func (h *Handler) authStatus(w http.ResponseWriter, r *http.Request, params url.Values) {
+	h.mu.Lock()
+	t, known := h.txns[params.Get("txid")]
+	var answerAt time.Time
+	if known {
+		answerAt = t.answerAt
+	}
+	h.mu.Unlock()
+
+	if !known {
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", "txid")
+		return
+	}
+	if !waitUntil(r, answerAt) {
+		return
+	}
+
+	h.mu.Lock()
+	t.polls++
+	polls := t.polls
+	waits := h.waits
+	h.mu.Unlock()
+
+	if (t.outcome == Timeout || t.outcome == WaitingThenAllow) && polls <= waits {
+		writeOK(w, map[string]interface{}{"result": "waiting", "status": "pushed", "status_msg": "Pushed a login request to your device..."})
+		return
+	}
+
+	writeOK(w, answer(t.outcome))
+}
+
+// enroll starts enrolling a new user, who's activated after fake_duo.waits checks of enroll_status
+func (h *Handler) enroll(w http.ResponseWriter, params url.Values) {
+	username := params.Get("username")
+	if username == "" {
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", "username")
+		return
+	}
+	if _, known := h.user(username); known {
+		writeFail(w, http.StatusBadRequest, codeInvalidParams, "Invalid request parameters", "username already exists")
+		return
+	}
+
+	e := enrollment{user: username, userID: "DU" + strings.ToUpper(newTxid()[:18])}
+	code := "duo://" + newTxid()
+	h.mu.Lock()
+	h.enrollments[code] = &e
+	h.mu.Unlock()
+
+	writeOK(w, map[string]interface{}{
+		"activation_barcode": "https://fake-duo.example.com/frame/qr?value=" + url.QueryEscape(code),
+		"activation_code":    code,
+		"expiration":         time.Now().Add(24 * time.Hour).Unix(),
+		"user_id":            e.userID,
+		"username":           username,
+	})
+}
+
+func (h *Handler) enrollStatus(w http.ResponseWriter, params url.Values) {
+	h.mu.Lock()
+	e, known := h.enrollments[params.Get("activation_code")]
+	known = known && e.userID == params.Get("user_id")
+	var polls int
+	if known {
+		e.polls++
+		polls = e.polls
+		if polls > h.waits {
+			delete(h.enrollments, params.Get("activation_code"))
+			h.users[e.user] = User{Outcome: Allow, Passcode: DefaultPasscode}
+		}
+	}
+	waits := h.waits
+	h.mu.Unlock()
+
+	switch {
+	case !known:
+		writeOK(w, "invalid")
+	case polls <= waits:
+		writeOK(w, "waiting")
+	default:
+		writeOK(w, "success")
+	}
+}
+
+// answer is DUO's final answer to a prompt with outcome o
+func answer(o Outcome) map[string]interface{} {
+	switch o {
+	case Allow, WaitingThenAllow:
+		return map[string]interface{}{"result": "allow", "status": "allow", "status_msg": "Success. Logging you in..."}
+	case Fraud:
+		return map[string]interface{}{"result": "deny", "status": "fraud", "status_msg": "Login request reported as fraudulent."}
+	case Timeout:
+		return map[string]interface{}{"result": "deny", "status": "timeout", "status_msg": "Login timed out."}
+	case Bypass:
+		return map[string]interface{}{"result": "allow", "status": "bypass", "status_msg": "Allowing unknown user"}
+	case LockedOut:
+		return map[string]interface{}{"result": "deny", "status": "locked_out", "status_msg": "Your account is disabled"}
+	default:
+		return map[string]interface{}{"result": "deny", "status": "deny", "status_msg": "Login request denied."}
+	}
+}
+
+// waitUntil blocks until t, returning false if the caller gives up first
+func waitUntil(r *http.Request, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-r.Context().Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func writeOK(w http.ResponseWriter, response interface{}) {
+	write(w, http.StatusOK, map[string]interface{}{"stat": "OK", "response": response})
+}
+
+func writeFail(w http.ResponseWriter, status int, code int, msg string, detail string) {
+	body := map[string]interface{}{"stat": "FAIL", "code": code, "message": msg}
+	if detail != "" {
+		body["message_detail"] = detail
+	}
+	write(w, status, body)
+}
+
+func write(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newTxid() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	h := hex.EncodeToString(b)
+	return strings.Join([]string{h[0:8], h[8:12], h[12:16], h[16:20], h[20:]}, "-")
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package duotest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/duoclient"
+)
+
+// Server is a fake Auth API listening on a local port, for tests
+type Server struct {
+	*Handler
+	// Host is what to set duo.host to
+	Host string
+
+	srv    *httptest.Server
+	caFile string
+}
+
+// NewServer starts a fake Auth API accepting requests signed with ikey and skey.  Close it when done.
+func NewServer(ikey string, skey string) (*Server, error) {
+	h := NewHandler(ikey, skey)
+	srv := httptest.NewTLSServer(h)
+
+	// DUO's API is only ever reached over TLS, so hand its certificate over for the client to trust
+	f, err := ioutil.TempFile("", "duotest-ca")
+	if err != nil {
+		srv.Close()
+		return nil, errors.Wrap(err, "error creating CA file for fake DUO")
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}); err != nil {
+		srv.Close()
+		_ = os.Remove(f.Name())
+		return nil, errors.Wrap(err, "error writing CA file for fake DUO")
+	}
+
+	return &Server{
+		Handler: h,
+		Host:    strings.TrimPrefix(srv.URL, "https://"),
+		srv:     srv,
+		caFile:  f.Name(),
+	}, nil
+}
+
+// ClientConfig returns config for a duoclient.Client talking to s
+func (s *Server) ClientConfig() duoclient.Config {
+	return duoclient.Config{
+		Host:   s.Host,
+		Ikey:   s.ikey,
+		Skey:   s.skey,
+		CAFile: s.caFile,
+	}
+}
+
+// CAFile returns a file holding the certificate s serves, to set duo.ca_file to
+func (s *Server) CAFile() string {
+	return s.caFile
+}
+
+// Close stops s
+func (s *Server) Close() {
+	s.srv.Close()
+	_ = os.Remove(s.caFile)
+}
+
+// SelfSignedCert returns a certificate for hosts, and its PEM encoding to trust it by
+func SelfSignedCert(hosts []string) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, errors.Wrap(err, "error generating key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, errors.Wrap(err, "error generating serial number")
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "fake-duo"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, errors.Wrap(err, "error creating certificate")
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -85,9 +85,9 @@ if [[ "${key:-x}" != "x" ]]; then
         echo "Sending DUO push to user ${GITHUB_USER_LOGIN}"
         echo "Accept DUO push and try again"
 
-        extraMeta="Application=Github Enterprise&repository=${GITHUB_REPO_NAME}"
+        extraMeta="\"Application\": \"Github Enterprise\", \"repository\": \"${GITHUB_REPO_NAME}\""
         if [[ "${GITHUB_VIA:-x}" != "x" ]]; then
-            extraMeta="${extraMeta}&Method=${GITHUB_VIA}"
+            extraMeta="${extraMeta}, \"Method\": \"${GITHUB_VIA}\""
         fi
 
         curl \
@@ -96,7 +96,7 @@ if [[ "${key:-x}" != "x" ]]; then
             --cacert $cacert \
             -X POST \
             -H 'Content-Type: application/json' \
-            -d "{ \"duoPushInfo\": \"${extraMeta}\" }" \
+            -d "{ \"metadata\": { ${extraMeta} } }" \
             "${URL}/push/${key}?user=${GITHUB_USER_LOGIN}&async=1"
 
         exit 1
@@ -0,0 +1,237 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package identity maps the names callers know users by, e.g. GitHub logins, to their DUO usernames
+package identity
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultReloadInterval is how often a mapping file is checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// Case normalizations applied to caller identities
+const (
+	CaseNone  = ""
+	CaseLower = "lower"
+	CaseUpper = "upper"
+)
+
+// A Rule rewrites identities matching a regular expression, with $1 style references to its groups
+type Rule struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+}
+
+// Config is everything needed to build a Mapper
+type Config struct {
+	// Optional, a YAML map of caller identities to DUO usernames, consulted before Rules
+	File string `mapstructure:"file"`
+	// Applied in order to identities not in File, each to the output of the one before
+	Rules []Rule `mapstructure:"rules"`
+	// One of CaseLower, CaseUpper or CaseNone, applied to caller identities before anything else
+	Case string `mapstructure:"case"`
+	// How often File is checked for changes, defaults to DefaultReloadInterval
+	ReloadInterval time.Duration `mapstructure:"reload_interval"`
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// A Mapper turns caller identities into DUO usernames.  Its mapping file is reloaded when it changes.
+type Mapper struct {
+	file           string
+	rules          []rule
+	normalize      func(string) string
+	reloadInterval time.Duration
+
+	mu      sync.RWMutex
+	static  map[string]string
+	modTime time.Time
+	size    int64
+	// How the file was last loaded
+	loadedAt time.Time
+	loadErr  error
+}
+
+// Status is how a Mapper's file was last loaded
+type Status struct {
+	File string
+	// When the mapping in use was loaded
+	LoadedAt time.Time
+	// Why the file couldn't be loaded since, if it couldn't.  The mapping loaded before is still in use.
+	Err error
+}
+
+// New returns a Mapper for cfg, having loaded its mapping file if it has one
+func New(cfg Config) (*Mapper, error) {
+	m := Mapper{
+		file:           cfg.File,
+		reloadInterval: cfg.ReloadInterval,
+	}
+	if m.reloadInterval <= 0 {
+		m.reloadInterval = DefaultReloadInterval
+	}
+
+	switch strings.ToLower(cfg.Case) {
+	case CaseNone:
+		m.normalize = func(s string) string { return s }
+	case CaseLower:
+		m.normalize = strings.ToLower
+	case CaseUpper:
+		m.normalize = strings.ToUpper
+	default:
+		return nil, errors.Errorf("unknown case '%s', must be %s or %s", cfg.Case, CaseLower, CaseUpper)
+	}
+
+	for i, r := range cfg.Rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %d has an invalid match", i)
+		}
+		m.rules = append(m.rules, rule{re: re, replace: r.Replace})
+	}
+
+	if m.file != "" {
+		if _, err := m.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// Map returns the DUO username for a caller identity
+func (m *Mapper) Map(name string) (string, error) {
+	name = m.normalize(strings.TrimSpace(name))
+
+	m.mu.RLock()
+	mapped, ok := m.static[name]
+	m.mu.RUnlock()
+	if ok {
+		return mapped, nil
+	}
+
+	mapped = name
+	for _, r := range m.rules {
+		mapped = r.re.ReplaceAllString(mapped, r.replace)
+	}
+	if mapped == "" {
+		return "", errors.Errorf("identity '%s' maps to an empty DUO username", name)
+	}
+	return mapped, nil
+}
+
+// Status returns how the mapping file was last loaded
+func (m *Mapper) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Status{File: m.file, LoadedAt: m.loadedAt, Err: m.loadErr}
+}
+
+// Reload reads the mapping file again if it's changed since it was last read, saying whether it was.
+// The mapping in use is kept if the file can't be read, and the error is kept for Status until it can.
+func (m *Mapper) Reload() (bool, error) {
+	reloaded, err := m.reload()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil:
+		m.loadErr = err
+	case reloaded:
+		m.loadedAt = time.Now()
+		m.loadErr = nil
+	}
+	return reloaded, err
+}
+
+func (m *Mapper) reload() (bool, error) {
+	fi, err := os.Stat(m.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading identity mapping %s", m.file)
+	}
+
+	// A broken file is only reported once, not on every check until it's fixed
+	m.mu.Lock()
+	unchanged := m.static != nil && fi.ModTime().Equal(m.modTime) && fi.Size() == m.size
+	m.modTime = fi.ModTime()
+	m.size = fi.Size()
+	m.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(m.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading identity mapping %s", m.file)
+	}
+	var raw map[string]string
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return false, errors.Wrapf(err, "error parsing identity mapping %s", m.file)
+	}
+
+	static := make(map[string]string, len(raw))
+	for from, to := range raw {
+		key := m.normalize(strings.TrimSpace(from))
+		if _, ok := static[key]; ok {
+			return false, errors.Errorf("identity mapping %s maps '%s' twice", m.file, key)
+		}
+		if strings.TrimSpace(to) == "" {
+			return false, errors.Errorf("identity mapping %s maps '%s' to an empty DUO username", m.file, key)
+		}
+		static[key] = strings.TrimSpace(to)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.static = static
+	return true, nil
+}
+
+// Watch reloads the mapping file whenever it changes, until ctx is done
+func (m *Mapper) Watch(ctx context.Context) {
+	if m.file == "" {
+		return
+	}
+
+	ticker := time.NewTicker(m.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := m.Reload()
+			if err != nil {
+				log.Warn(errors.Wrap(err, "Keeping the previous identity mapping"))
+			} else if reloaded {
+				log.Infof("Reloaded identity mapping from %s", m.file)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeMapping(t *testing.T, path string, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yml")
+	writeMapping(t, path, "octocat: alice\n")
+
+	m, err := New(Config{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := m.Status()
+	if status.Err != nil || status.LoadedAt.IsZero() || status.File != path {
+		t.Fatalf("unexpected status once loaded: %+v", status)
+	}
+	loadedAt := status.LoadedAt
+
+	writeMapping(t, path, "octocat: [alice\n")
+	if _, err := m.Reload(); err == nil {
+		t.Fatal("reloaded a mapping that isn't valid YAML")
+	}
+	// Still broken on the next check, even though the file hasn't changed since
+	if _, err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status := m.Status(); status.Err == nil || !status.LoadedAt.Equal(loadedAt) {
+		t.Errorf("expected the failed reload to be reported, got %+v", status)
+	}
+	if mapped, _ := m.Map("octocat"); mapped != "alice" {
+		t.Errorf("expected the previous mapping to be kept, octocat maps to %s", mapped)
+	}
+
+	writeMapping(t, path, "octocat: carol\n")
+	if _, err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status := m.Status(); status.Err != nil {
+		t.Errorf("expected the error to clear once the mapping loaded, got %v", status.Err)
+	}
+	if mapped, _ := m.Map("octocat"); mapped != "carol" {
+		t.Errorf("expected the new mapping, octocat maps to %s", mapped)
+	}
+}
+
+func TestMap(t *testing.T) {
+	m, err := New(Config{
+		Case:  CaseLower,
+		Rules: []Rule{{Match: `^(.*)@example\.com$`, Replace: "$1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"Alice@Example.com": "alice",
+		" bob ":             "bob",
+	} {
+		if got, err := m.Map(name); err != nil || got != want {
+			t.Errorf("%q mapped to %q (%v), want %q", name, got, err, want)
+		}
+	}
+	if _, err := m.Map("@example.com"); err == nil {
+		t.Error("mapped a name to an empty DUO username")
+	}
+}
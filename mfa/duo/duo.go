@@ -0,0 +1,293 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package duo is the DUO Auth API as an mfa.Provider
+package duo
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/duosecurity/duo_api_golang/authapi"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/duoclient"
+	"github.com/palantir/duo-bot/mfa"
+)
+
+const (
+	// Name is the DUO provider's name in config
+	Name = "duo"
+
+	// Arbitrary string to display in push notifications as the type, unless the request has its own
+	// https://duo.com/docs/authapi#/auth (see type under Duo Push)
+	duoAuthType = "Transaction"
+
+	// MaxPushInfoSize is DUO's limit on the size of the URL-encoded pushinfo
+	MaxPushInfoSize = 20 * 1024
+)
+
+// Provider challenges users through DUO
+type Provider struct {
+	api *duoclient.Client
+}
+
+var (
+	_ mfa.Provider = (*Provider)(nil)
+	_ mfa.Enroller = (*Provider)(nil)
+)
+
+// New returns a Provider calling DUO through api
+func New(api *duoclient.Client) *Provider {
+	return &Provider{api: api}
+}
+
+// Name returns "duo"
+func (p *Provider) Name() string {
+	return Name
+}
+
+// Preflight calls DUO's preauth for user
+func (p *Provider) Preflight(ctx context.Context, req mfa.PreflightRequest) (*mfa.PreflightResult, error) {
+	options := []func(*url.Values){authapi.PreauthUsername(req.User)}
+	if req.IPAddr != "" {
+		options = append(options, authapi.PreauthIpAddr(req.IPAddr))
+	}
+
+	res, err := p.api.Preauth(ctx, options...)
+	if err != nil {
+		return nil, wrap(err, "Error calling DUO preauth")
+	}
+	if err := statErr(&res.StatResult, "preauth"); err != nil {
+		return nil, err
+	}
+
+	pr := mfa.PreflightResult{
+		Result:    res.Response.Result,
+		Message:   res.Response.Status_Msg,
+		EnrollURL: res.Response.Enroll_Portal_Url,
+	}
+	for _, d := range res.Response.Devices {
+		pr.Devices = append(pr.Devices, mfa.Device{
+			ID:           d.Device,
+			Type:         d.Type,
+			Name:         d.Name,
+			Number:       d.Number,
+			Capabilities: d.Capabilities,
+		})
+	}
+
+	return &pr, nil
+}
+
+// ListDevices returns the devices DUO's preauth lists for user
+func (p *Provider) ListDevices(ctx context.Context, user string) ([]mfa.Device, error) {
+	pr, err := p.Preflight(ctx, mfa.PreflightRequest{User: user})
+	if err != nil {
+		return nil, err
+	}
+	return pr.Devices, nil
+}
+
+// Challenge calls DUO's auth for push, phone or sms
+func (p *Provider) Challenge(ctx context.Context, req mfa.ChallengeRequest) (*mfa.Result, error) {
+	log.WithFields(log.Fields{
+		"factor":   req.Factor,
+		"username": req.User,
+		"device":   req.Device,
+		"async":    req.Async,
+	}).Debug("Issuing DUO call")
+
+	options := []func(*url.Values){
+		authapi.AuthUsername(req.User),
+		authapi.AuthDevice(req.Device),
+	}
+
+	if req.IPAddr != "" {
+		options = append(options, authapi.AuthIpAddr(req.IPAddr))
+	}
+	if req.DisplayUsername != "" {
+		options = append(options, authapi.AuthDisplayUsername(req.DisplayUsername))
+	}
+
+	// phone and push can use this
+	if req.Async {
+		options = append(options, authapi.AuthAsync())
+	}
+
+	if req.Factor == "push" {
+		pushType := req.PushType
+		if pushType == "" {
+			pushType = duoAuthType
+		}
+		options = append(options, authapi.AuthPushinfo(EncodePushInfo(req.PushInfo)), authapi.AuthType(pushType))
+	}
+
+	return p.auth(ctx, req.Factor, options...)
+}
+
+// EncodePushInfo returns fields URL-encoded as DUO's pushinfo, keeping their order
+func EncodePushInfo(fields []mfa.PushField) string {
+	pairs := make([]string, len(fields))
+	for i, f := range fields {
+		pairs[i] = url.QueryEscape(f.Name) + "=" + url.QueryEscape(f.Value)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// VerifyPasscode calls DUO's auth with a passcode
+func (p *Provider) VerifyPasscode(ctx context.Context, req mfa.PasscodeRequest) (*mfa.Result, error) {
+	log.WithFields(log.Fields{
+		"factor":   "passcode",
+		"username": req.User,
+	}).Debug("Issuing DUO call")
+
+	options := []func(*url.Values){
+		authapi.AuthUsername(req.User),
+		authapi.AuthPasscode(req.Passcode),
+	}
+	if req.IPAddr != "" {
+		options = append(options, authapi.AuthIpAddr(req.IPAddr))
+	}
+
+	return p.auth(ctx, "passcode", options...)
+}
+
+func (p *Provider) auth(ctx context.Context, factor string, options ...func(*url.Values)) (*mfa.Result, error) {
+	res, err := p.api.Auth(ctx, factor, options...)
+	if err != nil {
+		return nil, wrap(err, "Error calling DUO")
+	}
+
+	// If the username specified doesn't exist
+	if err := statErr(&res.StatResult, "auth"); err != nil {
+		return nil, err
+	}
+
+	// The only successful response from an async call
+	if res.Response.Txid != "" {
+		return &mfa.Result{Status: mfa.StatusWaiting, TxID: res.Response.Txid}, nil
+	}
+
+	// sms never authenticates anyone by itself, it sends passcodes for the user to answer with
+	if factor == "sms" && res.Response.Status == "sent" {
+		return &mfa.Result{Status: mfa.StatusPasscodeSent, ProviderStatus: res.Response.Status, Message: res.Response.Status_Msg}, nil
+	}
+
+	// The only successful response from a blocking call
+	if res.Response.Status == "allow" {
+		return &mfa.Result{Status: mfa.StatusAllowed, ProviderStatus: res.Response.Status, Message: res.Response.Status_Msg}, nil
+	}
+
+	// Fail closed
+	return &mfa.Result{Status: mfa.StatusDenied, ProviderStatus: res.Response.Status, Message: res.Response.Status_Msg}, nil
+}
+
+// Poll calls DUO's auth_status, which blocks until the transaction's status changes
+func (p *Provider) Poll(ctx context.Context, txid string) (*mfa.Result, error) {
+	res, err := p.api.AuthStatus(ctx, txid)
+	if err != nil {
+		return nil, wrap(err, "Error checking DUO auth status")
+	}
+	if err := statErr(&res.StatResult, "auth_status"); err != nil {
+		return nil, err
+	}
+
+	r := mfa.Result{
+		TxID:           txid,
+		ProviderStatus: res.Response.Status,
+		Message:        res.Response.Status_Msg,
+	}
+
+	switch res.Response.Result {
+	case "allow":
+		// The only true condition - the async request has been accepted
+		r.Status = mfa.StatusAllowed
+	case "waiting":
+		// We're waiting, but haven't been rejected yet
+		r.Status = mfa.StatusWaiting
+	default:
+		// Fail closed, an explicit deny whould hit this
+		r.Status = mfa.StatusDenied
+	}
+
+	return &r, nil
+}
+
+// Enroll calls DUO's enroll, creating user in DUO with a device to activate
+func (p *Provider) Enroll(ctx context.Context, user string) (*mfa.Enrollment, error) {
+	res, err := p.api.Enroll(ctx, authapi.EnrollUsername(user))
+	if err != nil {
+		return nil, wrap(err, "Error calling DUO enroll")
+	}
+	if err := statErr(&res.StatResult, "enroll"); err != nil {
+		return nil, err
+	}
+
+	return &mfa.Enrollment{
+		User:           res.Response.Username,
+		UserID:         res.Response.User_Id,
+		ActivationCode: res.Response.Activation_Code,
+		BarcodeURL:     res.Response.Activation_Barcode,
+		Expires:        time.Unix(res.Response.Expiration, 0),
+	}, nil
+}
+
+// EnrollStatus calls DUO's enroll_status
+func (p *Provider) EnrollStatus(ctx context.Context, userID string, activationCode string) (string, error) {
+	res, err := p.api.EnrollStatus(ctx, userID, activationCode)
+	if err != nil {
+		return "", wrap(err, "Error calling DUO enroll_status")
+	}
+	if err := statErr(&res.StatResult, "enroll_status"); err != nil {
+		return "", err
+	}
+
+	switch res.Response {
+	case mfa.EnrollmentSuccess, mfa.EnrollmentWaiting:
+		return res.Response, nil
+	default:
+		return mfa.EnrollmentInvalid, nil
+	}
+}
+
+// wrap marks DUO being down as the provider being unavailable
+func wrap(err error, msg string) error {
+	err = errors.Wrap(err, msg)
+	if duoclient.IsUnavailable(err) {
+		return mfa.Unavailable(err)
+	}
+	return err
+}
+
+// statErr returns an error if DUO answered a call with a failure rather than a result
+func statErr(stat *authapi.StatResult, endpoint string) error {
+	if stat.Stat == "OK" {
+		return nil
+	}
+
+	msg := "unknown error"
+	if stat.Message != nil {
+		msg = *stat.Message
+	}
+	err := errors.Errorf("Error reported by DUO %s: %s\n", endpoint, msg)
+
+	if stat.Code != nil && *stat.Code == duoclient.RateLimitCode {
+		return mfa.RateLimited(err)
+	}
+	return err
+}
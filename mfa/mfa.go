@@ -0,0 +1,199 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mfa is what duo-bot needs from an MFA vendor, so DUO can be one backend among several.
+package mfa
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status is where a challenge has got to
+type Status int
+
+const (
+	// StatusWaiting means the user hasn't answered yet
+	StatusWaiting Status = iota
+	// StatusAllowed means the user approved the challenge
+	StatusAllowed
+	// StatusDenied means the user refused the challenge, or it failed
+	StatusDenied
+	// StatusPasscodeSent means passcodes were sent to the user, and the challenge is answered with VerifyPasscode
+	StatusPasscodeSent
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusWaiting:
+		return "waiting"
+	case StatusAllowed:
+		return "allowed"
+	case StatusDenied:
+		return "denied"
+	case StatusPasscodeSent:
+		return "passcode_sent"
+	default:
+		return "unknown"
+	}
+}
+
+// A Device is something a user can be challenged on
+type Device struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Name   string `json:"name,omitempty"`
+	Number string `json:"number,omitempty"`
+	// Factors the device supports, e.g. push, sms, phone or mobile_otp
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// PreflightResult is what the provider says about a user before challenging them
+type PreflightResult struct {
+	// One of auth (challenge them), allow (let them through without a challenge),
+	// deny (don't let them through) or enroll (they have no devices)
+	Result    string
+	Message   string
+	EnrollURL string
+	Devices   []Device
+}
+
+// PreflightRequest is a user to check on before challenging them
+type PreflightRequest struct {
+	User string
+	// The IP address the user is acting from, for the provider's network policies.  Optional.
+	IPAddr string
+}
+
+// ChallengeRequest is a challenge to send to a user
+type ChallengeRequest struct {
+	// The duo-bot key the challenge is for
+	Key    string
+	User   string
+	Factor string
+	Device string
+	// Whether to return straight away with a TxID to Poll, rather than waiting for the user to answer
+	Async bool
+	// What kind of request a push is, e.g. "Login request", defaults to the provider's own.  Optional.
+	PushType string
+	// Key/value pairs to show the user in order, for providers that can
+	PushInfo []PushField
+	// The IP address the user is acting from, for the provider's network policies.  Optional.
+	IPAddr string
+	// The name to show the user in the challenge, if not User.  Optional.
+	DisplayUsername string
+}
+
+// A PushField is a key/value pair shown to the user with a push
+type PushField struct {
+	Name  string
+	Value string
+}
+
+// PasscodeRequest is a passcode to check
+type PasscodeRequest struct {
+	User     string
+	Passcode string
+	// The IP address the user is acting from, for the provider's network policies.  Optional.
+	IPAddr string
+}
+
+// Result is where a challenge has got to
+type Result struct {
+	Status Status
+	// Identifies an async challenge to Poll
+	TxID string
+	// The provider's own word for the outcome, e.g. DUO's allow, deny, fraud or locked_out
+	ProviderStatus string
+	Message        string
+}
+
+// A Provider is an MFA vendor.  Implementations must be safe for concurrent use.
+type Provider interface {
+	// Name identifies the provider in config and persisted state
+	Name() string
+	// Preflight checks whether and how user can be challenged
+	Preflight(ctx context.Context, req PreflightRequest) (*PreflightResult, error)
+	// Challenge sends a challenge, returning a TxID to Poll if it's async
+	Challenge(ctx context.Context, req ChallengeRequest) (*Result, error)
+	// Poll checks on an async challenge
+	Poll(ctx context.Context, txid string) (*Result, error)
+	// VerifyPasscode checks a passcode the user read off a device
+	VerifyPasscode(ctx context.Context, req PasscodeRequest) (*Result, error)
+	// ListDevices returns the devices user can be challenged on
+	ListDevices(ctx context.Context, user string) ([]Device, error)
+}
+
+// An Enrollment is a new device a user has been asked to activate
+type Enrollment struct {
+	User string `json:"user"`
+	// The provider's ID for the user, needed to check on the enrollment
+	UserID string `json:"userID"`
+	// Scanning the barcode in the provider's app activates the enrollment, as does following the code as a link
+	ActivationCode string    `json:"activationCode"`
+	BarcodeURL     string    `json:"barcodeURL"`
+	Expires        time.Time `json:"expires"`
+}
+
+// Enrollment statuses
+const (
+	// EnrollmentWaiting means the user hasn't activated the enrollment yet
+	EnrollmentWaiting = "waiting"
+	// EnrollmentSuccess means the user has activated the enrollment
+	EnrollmentSuccess = "success"
+	// EnrollmentInvalid means the enrollment has expired, or doesn't exist
+	EnrollmentInvalid = "invalid"
+)
+
+// An Enroller is a Provider users can enroll with through duo-bot
+type Enroller interface {
+	// Enroll starts enrolling a new device for user
+	Enroll(ctx context.Context, user string) (*Enrollment, error)
+	// EnrollStatus returns whether an enrollment has been activated, as one of the Enrollment statuses
+	EnrollStatus(ctx context.Context, userID string, activationCode string) (string, error)
+}
+
+// unavailableError is the provider being down or unreachable, so it's worth trying again later
+type unavailableError struct {
+	error
+}
+
+// rateLimitedError is the provider refusing to answer because we're calling it too often
+type rateLimitedError struct {
+	error
+}
+
+// Unavailable marks err as the provider being down or unreachable
+func Unavailable(err error) error {
+	return &unavailableError{err}
+}
+
+// IsUnavailable returns whether err means the provider is down or unreachable
+func IsUnavailable(err error) bool {
+	_, ok := errors.Cause(err).(*unavailableError)
+	return ok
+}
+
+// RateLimited marks err as the provider rate limiting us
+func RateLimited(err error) error {
+	return &rateLimitedError{err}
+}
+
+// IsRateLimited returns whether err means the provider is rate limiting us
+func IsRateLimited(err error) bool {
+	_, ok := errors.Cause(err).(*rateLimitedError)
+	return ok
+}
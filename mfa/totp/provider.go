@@ -0,0 +1,124 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package totp
+
+import (
+	"context"
+	"crypto/subtle"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/mfa"
+)
+
+const (
+	// Name is the TOTP provider's name in config
+	Name = "totp"
+
+	// How many steps either side of now a code is accepted from, for clock drift and slow typists
+	skewSteps = 1
+
+	// The only device a TOTP user has
+	deviceID = "totp"
+)
+
+// Provider verifies codes from users' authenticator apps against the secrets in a Store.
+// It only verifies passcodes, there's nothing to push to.
+type Provider struct {
+	store *Store
+}
+
+// New returns a Provider checking codes against the secrets in store
+func New(store *Store) *Provider {
+	return &Provider{
+		store: store,
+	}
+}
+
+// Name returns "totp"
+func (p *Provider) Name() string {
+	return Name
+}
+
+// Preflight says whether user is enrolled
+func (p *Provider) Preflight(ctx context.Context, req mfa.PreflightRequest) (*mfa.PreflightResult, error) {
+	devices, err := p.ListDevices(ctx, req.User)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return &mfa.PreflightResult{Result: "enroll", Message: "Not enrolled for TOTP"}, nil
+	}
+	return &mfa.PreflightResult{Result: "auth", Message: "Account is active", Devices: devices}, nil
+}
+
+// ListDevices returns the user's authenticator app, if they're enrolled
+func (p *Provider) ListDevices(ctx context.Context, user string) ([]mfa.Device, error) {
+	_, ok, err := p.store.Secret(user)
+	if err != nil {
+		return nil, mfa.Unavailable(err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return []mfa.Device{{
+		ID:           deviceID,
+		Type:         "token",
+		Name:         "Authenticator app",
+		Capabilities: []string{"mobile_otp"},
+	}}, nil
+}
+
+// Challenge always fails, TOTP codes can only be checked with VerifyPasscode
+func (p *Provider) Challenge(ctx context.Context, req mfa.ChallengeRequest) (*mfa.Result, error) {
+	return nil, errors.Errorf("the %s provider only accepts passcodes, not %s", Name, req.Factor)
+}
+
+// Poll always fails, there are never any async transactions
+func (p *Provider) Poll(ctx context.Context, txid string) (*mfa.Result, error) {
+	return nil, errors.Errorf("the %s provider has no transaction %s", Name, txid)
+}
+
+// VerifyPasscode checks passcode is user's current code, and that it hasn't been used before
+func (p *Provider) VerifyPasscode(ctx context.Context, req mfa.PasscodeRequest) (*mfa.Result, error) {
+	user, passcode := req.User, req.Passcode
+	secret, ok, err := p.store.Secret(user)
+	if err != nil {
+		return nil, mfa.Unavailable(err)
+	}
+	if !ok {
+		return &mfa.Result{Status: mfa.StatusDenied, ProviderStatus: "deny", Message: "Not enrolled for TOTP"}, nil
+	}
+
+	now := step(time.Now())
+	for s := now - skewSteps; s <= now+skewSteps; s++ {
+		if subtle.ConstantTimeCompare([]byte(code(secret, s)), []byte(passcode)) != 1 {
+			continue
+		}
+
+		// The step's kept with the secret, so a code can't be replayed after a restart either
+		fresh, err := p.store.UseStep(user, s)
+		if err != nil {
+			return nil, mfa.Unavailable(err)
+		}
+		if !fresh {
+			return &mfa.Result{Status: mfa.StatusDenied, ProviderStatus: "deny", Message: "Passcode already used"}, nil
+		}
+		return &mfa.Result{Status: mfa.StatusAllowed, ProviderStatus: "allow", Message: "Success. Logging you in..."}, nil
+	}
+
+	return &mfa.Result{Status: mfa.StatusDenied, ProviderStatus: "deny", Message: "Incorrect passcode. Please try again."}, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package totp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/palantir/duo-bot/mfa"
+)
+
+func tempStore(t *testing.T) (string, []byte) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "totp.json"), make([]byte, KeySize)
+}
+
+func openStore(t *testing.T, path string, key []byte) *Store {
+	s, err := NewStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func verify(t *testing.T, p *Provider, user string, passcode string) *mfa.Result {
+	res, err := p.VerifyPasscode(context.Background(), mfa.PasscodeRequest{User: user, Passcode: passcode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestVerifyPasscode(t *testing.T) {
+	path, key := tempStore(t)
+	store := openStore(t, path, key)
+	secret, err := store.Enroll("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(store)
+
+	if res := verify(t, p, "alice", Code(secret, time.Now().Add(time.Hour))); res.Status != mfa.StatusDenied {
+		t.Errorf("wrong passcode was %s", res.Status)
+	}
+	if res := verify(t, p, "bob", Code(secret, time.Now())); res.Status != mfa.StatusDenied {
+		t.Errorf("passcode for a user who isn't enrolled was %s", res.Status)
+	}
+
+	passcode := Code(secret, time.Now())
+	if res := verify(t, p, "alice", passcode); res.Status != mfa.StatusAllowed {
+		t.Fatalf("current passcode was %s: %s", res.Status, res.Message)
+	}
+	if res := verify(t, p, "alice", passcode); res.Status != mfa.StatusDenied {
+		t.Errorf("replayed passcode was %s", res.Status)
+	}
+
+	// Nor after a restart
+	p = New(openStore(t, path, key))
+	if res := verify(t, p, "alice", passcode); res.Status != mfa.StatusDenied {
+		t.Errorf("passcode replayed after reopening the store was %s", res.Status)
+	}
+
+	// Nor an earlier code still within the skew
+	earlier := Code(secret, time.Now().Add(-Period))
+	if res := verify(t, p, "alice", earlier); res.Status != mfa.StatusDenied {
+		t.Errorf("passcode older than the last one used was %s", res.Status)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	path, key := tempStore(t)
+	if _, err := openStore(t, path, key).Enroll("alice", false); err != nil {
+		t.Fatal(err)
+	}
+
+	other := make([]byte, KeySize)
+	other[0] = 1
+	if _, err := NewStore(path, other); err == nil {
+		t.Error("opened the store with the wrong key")
+	}
+}
+
+func TestEnrollReplace(t *testing.T) {
+	path, key := tempStore(t)
+	store := openStore(t, path, key)
+	first, err := store.Enroll("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Enroll("alice", false); err == nil {
+		t.Error("re-enrolled without replacing")
+	}
+	second, err := store.Enroll("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := store.Secret("alice"); string(got) != string(second) || string(got) == string(first) {
+		t.Error("secret wasn't replaced")
+	}
+}
+
+func TestLegacyStore(t *testing.T) {
+	path, key := tempStore(t)
+	store := openStore(t, path, key)
+
+	// Before the last step was kept, each user only had their secret
+	secret := []byte("12345678901234567890")
+	plain, err := json.Marshal(map[string][]byte{"alice": secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, store.aead.NonceSize())
+	b, err := json.Marshal(storeFile{Nonce: nonce, Ciphertext: store.aead.Seal(nil, nonce, plain, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(openStore(t, path, key))
+	passcode := Code(secret, time.Now())
+	if res := verify(t, p, "alice", passcode); res.Status != mfa.StatusAllowed {
+		t.Fatalf("passcode from a legacy store was %s: %s", res.Status, res.Message)
+	}
+	if res := verify(t, p, "alice", passcode); res.Status != mfa.StatusDenied {
+		t.Errorf("replayed passcode from a legacy store was %s", res.Status)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/atomicfile"
+)
+
+// KeySize is the size of the key the store is encrypted with, for AES-256
+const KeySize = 32
+
+// storeFile is how the store is laid out on disk
+type storeFile struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// enrolled is what's kept for each enrolled user
+type enrolled struct {
+	Secret []byte `json:"secret"`
+	// The step of the last code the user got in with, so it can't be used again, even after a restart
+	LastStep int64 `json:"lastStep,omitempty"`
+}
+
+// UnmarshalJSON also reads stores from before the last step was kept, which only held each user's secret
+func (e *enrolled) UnmarshalJSON(b []byte) error {
+	var secret []byte
+	if err := json.Unmarshal(b, &secret); err == nil {
+		*e = enrolled{Secret: secret}
+		return nil
+	}
+
+	type plain enrolled
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+// A Store holds each enrolled user's secret, and the last code they used, encrypted on disk with AES-GCM.
+// It's read from disk on every lookup, so enrollments show up without a restart.
+type Store struct {
+	path string
+	aead cipher.AEAD
+
+	// Only guards writes from this process, enrolling or verifying codes from two at once isn't supported
+	mu sync.Mutex
+}
+
+// LoadKey reads a base64 encoded key of KeySize bytes from path
+func LoadKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading TOTP store key from %s", path)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "TOTP store key in %s isn't base64", path)
+	}
+	if len(key) != KeySize {
+		return nil, errors.Errorf("TOTP store key in %s is %d bytes, it must be %d", path, len(key), KeySize)
+	}
+	return key, nil
+}
+
+// NewStore returns the store at path, encrypted with key.  The file doesn't need to exist yet.
+func NewStore(path string, key []byte) (*Store, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating TOTP store cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating TOTP store cipher")
+	}
+
+	s := Store{
+		path: path,
+		aead: aead,
+	}
+
+	// Fail now rather than on the first prompt if the key is wrong
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Path returns where the store is kept
+func (s *Store) Path() string {
+	return s.path
+}
+
+// load decrypts every user's secret.  A missing file means no one is enrolled.
+func (s *Store) load() (map[string]enrolled, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return make(map[string]enrolled), nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading TOTP store %s", s.path)
+	}
+
+	var f storeFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, errors.Wrapf(err, "error parsing TOTP store %s", s.path)
+	}
+	plain, err := s.aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decrypting TOTP store %s, is the key right?", s.path)
+	}
+
+	secrets := make(map[string]enrolled)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, errors.Wrapf(err, "error parsing decrypted TOTP store %s", s.path)
+	}
+	return secrets, nil
+}
+
+// save encrypts secrets to disk, replacing what was there
+func (s *Store) save(secrets map[string]enrolled) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return errors.Wrap(err, "error serializing TOTP secrets")
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Wrap(err, "error generating TOTP store nonce")
+	}
+
+	b, err := json.Marshal(storeFile{
+		Nonce:      nonce,
+		Ciphertext: s.aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error serializing TOTP store")
+	}
+
+	return errors.Wrapf(atomicfile.WriteFile(s.path, b, 0600), "error writing TOTP store to %s", s.path)
+}
+
+// Secret returns user's secret, and whether they're enrolled
+func (s *Store) Secret(user string) ([]byte, bool, error) {
+	secrets, err := s.load()
+	if err != nil {
+		return nil, false, err
+	}
+	e, ok := secrets[user]
+	return e.Secret, ok, nil
+}
+
+// UseStep records that user got in with the code for step, returning false if they've already used that code or
+// a later one
+func (s *Store) UseStep(user string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return false, err
+	}
+	e, ok := secrets[user]
+	if !ok {
+		return false, errors.Errorf("%s is not enrolled", user)
+	}
+	if step <= e.LastStep {
+		return false, nil
+	}
+
+	e.LastStep = step
+	secrets[user] = e
+	return true, s.save(secrets)
+}
+
+// Enroll generates and stores a new secret for user.  Re-enrolling a user replaces their secret
+// only if replace is set.
+func (s *Store) Enroll(user string, replace bool) ([]byte, error) {
+	if user == "" {
+		return nil, errors.New("you must specify a user to enroll")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := secrets[user]; ok && !replace {
+		return nil, errors.Errorf("%s is already enrolled", user)
+	}
+
+	secret, err := NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	secrets[user] = enrolled{Secret: secret}
+
+	if err := s.save(secrets); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// JWKS is a JSON Web Key Set (RFC 7517) of the keys receipts are signed with
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// A JWK is an EC public key as a JSON Web Key
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func publicJWK(key *ecdsa.PublicKey) JWK {
+	k := JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   encodeCoordinate(key.X),
+		Y:   encodeCoordinate(key.Y),
+		Use: "sig",
+		Alg: signingMethod.Alg(),
+	}
+	k.Kid = k.thumbprint()
+	return k
+}
+
+// encodeCoordinate base64url encodes a P-256 coordinate, padded to its full 32 bytes
+func encodeCoordinate(n *big.Int) string {
+	b := make([]byte, 32)
+	nb := n.Bytes()
+	copy(b[len(b)-len(nb):], nb)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// thumbprint is the key's RFC 7638 thumbprint, which is its kid
+func (k JWK) thumbprint() string {
+	canonical := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k.Crv, k.Kty, k.X, k.Y)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (k JWK) publicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, errors.Errorf("key %s isn't a P-256 EC key", k.Kid)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %s has an invalid x", k.Kid)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %s has an invalid y", k.Kid)
+	}
+
+	key := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.Errorf("key %s isn't on P-256", k.Kid)
+	}
+	return &key, nil
+}
+
+// ParseJWKS reads a JWKS, e.g. as published by duo-bot
+func ParseJWKS(b []byte) (*JWKS, error) {
+	var set JWKS
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.Wrap(err, "error parsing JWKS")
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("JWKS has no keys")
+	}
+	return &set, nil
+}
+
+// Verify checks receipt was signed by one of the set's keys, by issuer, and hasn't expired, returning its claims
+func (set *JWKS) Verify(receipt string, issuer string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(receipt, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != signingMethod {
+			return nil, errors.Errorf("receipt is signed with %v, not %s", t.Header["alg"], signingMethod.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		for _, k := range set.Keys {
+			if k.Kid == kid {
+				return k.publicKey()
+			}
+		}
+		return nil, errors.Errorf("receipt is signed with unknown key '%s'", kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid receipt")
+	}
+	if !claims.VerifyIssuer(issuer, true) {
+		return nil, errors.Errorf("receipt was issued by '%s', not '%s'", claims.Issuer, issuer)
+	}
+	return &claims, nil
+}
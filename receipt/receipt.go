@@ -0,0 +1,172 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package receipt signs approvals as JWTs that can be verified offline, against the signing keys' JWKS
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/twinj/uuid"
+
+	"github.com/palantir/duo-bot/state"
+)
+
+const (
+	// DefaultIssuer is who receipts say issued them, unless configured otherwise
+	DefaultIssuer = "duo-bot"
+	// DefaultTTL is how long receipts are good for, unless configured otherwise.  They never outlast the approval.
+	DefaultTTL = 5 * time.Minute
+)
+
+// Receipts are signed with ECDSA P-256, which keeps them short
+var signingMethod = jwt.SigningMethodES256
+
+// Claims are what a receipt says about an approval
+type Claims struct {
+	// The approved key
+	Key       string `json:"key"`
+	Namespace string `json:"namespace,omitempty"`
+	Factor    string `json:"factor,omitempty"`
+	// When the approval was given, in seconds since the epoch
+	ApprovedAt int64 `json:"approved_at"`
+	// The context the approval is bound to, if it's bound
+	Binding *state.Binding `json:"binding,omitempty"`
+	// The ID of the grant that approved the key, if it wasn't approved itself
+	Grant string `json:"grant,omitempty"`
+
+	// The approver is the subject
+	jwt.StandardClaims
+}
+
+// Config is everything needed to build a Signer
+type Config struct {
+	// The first key signs, the rest are still published so receipts they signed verify while they're rotated out
+	Keys []*ecdsa.PrivateKey
+	// Defaults to DefaultIssuer
+	Issuer string
+	// Defaults to DefaultTTL
+	TTL time.Duration
+}
+
+// A Signer issues receipts
+type Signer struct {
+	keys   []*ecdsa.PrivateKey
+	kids   []string
+	issuer string
+	ttl    time.Duration
+}
+
+// New returns a Signer for cfg
+func New(cfg Config) (*Signer, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("no receipt signing keys")
+	}
+
+	s := Signer{
+		keys:   cfg.Keys,
+		issuer: cfg.Issuer,
+		ttl:    cfg.TTL,
+	}
+	if s.issuer == "" {
+		s.issuer = DefaultIssuer
+	}
+	if s.ttl <= 0 {
+		s.ttl = DefaultTTL
+	}
+
+	for i, key := range s.keys {
+		if key.Curve != elliptic.P256() {
+			return nil, errors.Errorf("receipt signing key %d isn't a P-256 key", i)
+		}
+		s.kids = append(s.kids, publicJWK(&key.PublicKey).Kid)
+	}
+	return &s, nil
+}
+
+// Issuer returns who receipts say issued them
+func (s *Signer) Issuer() string {
+	return s.issuer
+}
+
+// Sign returns a receipt for approval of key, filling in its standard claims
+func (s *Signer) Sign(c Claims, approval state.Approval) (string, error) {
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	if approval.Expires.Before(expires) {
+		expires = approval.Expires
+	}
+
+	c.Factor = approval.Factor
+	c.ApprovedAt = approval.At.Unix()
+	c.StandardClaims = jwt.StandardClaims{
+		Id:        uuid.NewV4().String(),
+		Issuer:    s.issuer,
+		Subject:   approval.User,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	}
+
+	token := jwt.NewWithClaims(signingMethod, c)
+	token.Header["kid"] = s.kids[0]
+	signed, err := token.SignedString(s.keys[0])
+	return signed, errors.Wrap(err, "error signing receipt")
+}
+
+// JWKS returns the public keys receipts can be verified with
+func (s *Signer) JWKS() *JWKS {
+	var set JWKS
+	for _, key := range s.keys {
+		set.Keys = append(set.Keys, publicJWK(&key.PublicKey))
+	}
+	return &set
+}
+
+// LoadKeys reads the PEM encoded ECDSA private keys at paths
+func LoadKeys(paths []string) ([]*ecdsa.PrivateKey, error) {
+	var keys []*ecdsa.PrivateKey
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading receipt signing key %s", path)
+		}
+		key, err := jwt.ParseECPrivateKeyFromPEM(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing receipt signing key %s", path)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// GenerateKey returns a new PEM encoded signing key
+func GenerateKey() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating receipt signing key")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding receipt signing key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/palantir/duo-bot/state"
+)
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	pem, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newSigner(t *testing.T, keys ...*ecdsa.PrivateKey) *Signer {
+	s, err := New(Config{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func approval() state.Approval {
+	return state.Approval{
+		User:    "alice",
+		Factor:  "push",
+		At:      time.Now().Add(-time.Minute),
+		Expires: time.Now().Add(time.Hour),
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	s := newSigner(t, newKey(t))
+	binding := state.NewBinding(map[string]string{"repo": "x/y"}, "", false)
+
+	signed, err := s.Sign(Claims{Key: "deploy-1", Namespace: "deploy", Binding: binding}, approval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := s.JWKS().Verify(signed, DefaultIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Key != "deploy-1" || claims.Namespace != "deploy" || claims.Subject != "alice" || claims.Factor != "push" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if len(claims.Binding.Mismatches(map[string]string{"repo": "x/y"}, "")) != 0 {
+		t.Errorf("binding didn't survive the round trip: %+v", claims.Binding)
+	}
+	if got := time.Unix(claims.ExpiresAt, 0); got.After(time.Now().Add(DefaultTTL)) {
+		t.Errorf("receipt expires at %v, after its TTL", got)
+	}
+}
+
+func TestNeverOutlastsApproval(t *testing.T) {
+	s := newSigner(t, newKey(t))
+	a := approval()
+	a.Expires = time.Now().Add(time.Minute)
+
+	signed, err := s.Sign(Claims{Key: "k"}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.JWKS().Verify(signed, DefaultIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ExpiresAt != a.Expires.Unix() {
+		t.Errorf("receipt expires at %d, not with the approval at %d", claims.ExpiresAt, a.Expires.Unix())
+	}
+}
+
+func TestRotation(t *testing.T) {
+	oldKey, newKey := newKey(t), newKey(t)
+
+	signed, err := newSigner(t, oldKey).Sign(Claims{Key: "k"}, approval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated: the new key signs, the old one is still published
+	rotated := newSigner(t, newKey, oldKey)
+	if _, err := rotated.JWKS().Verify(signed, DefaultIssuer); err != nil {
+		t.Errorf("receipt from the old key didn't verify while it's rotated out: %v", err)
+	}
+
+	// Retired: only the new key is published
+	if _, err := newSigner(t, newKey).JWKS().Verify(signed, DefaultIssuer); err == nil {
+		t.Error("receipt from a retired key verified")
+	}
+}
+
+func TestRejects(t *testing.T) {
+	key := newKey(t)
+	s := newSigner(t, key)
+	jwks := s.JWKS()
+
+	signed, err := s.Sign(Claims{Key: "k"}, approval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredApproval := approval()
+	expiredApproval.Expires = time.Now().Add(-time.Second)
+	expired, err := s.Sign(Claims{Key: "k"}, expiredApproval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := Claims{Key: "k", StandardClaims: jwt.StandardClaims{Issuer: DefaultIssuer, ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = jwks.Keys[0].Kid
+	unsigned, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed with the public key as an HMAC secret, in case a verifier would take it for one
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hs.Header["kid"] = jwks.Keys[0].Kid
+	confused, err := hs.SignedString([]byte(jwks.Keys[0].X))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey := jwt.NewWithClaims(signingMethod, claims)
+	otherKey.Header["kid"] = "someone-else"
+	unknownKid, err := otherKey.SignedString(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Claims a published kid, but signed with another key
+	forged := jwt.NewWithClaims(signingMethod, claims)
+	forged.Header["kid"] = jwks.Keys[0].Kid
+	wrongKey, err := forged.SignedString(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(signed, ".")
+	tampered := parts[0] + "." + strings.TrimRight(parts[1], "=") + "x." + parts[2]
+
+	for name, tc := range map[string]struct {
+		receipt string
+		issuer  string
+	}{
+		"wrong issuer": {signed, "someone-else"},
+		"expired":      {expired, DefaultIssuer},
+		"alg none":     {unsigned, DefaultIssuer},
+		"alg HS256":    {confused, DefaultIssuer},
+		"unknown kid":  {unknownKid, DefaultIssuer},
+		"wrong key":    {wrongKey, DefaultIssuer},
+		"tampered":     {tampered, DefaultIssuer},
+	} {
+		if _, err := jwks.Verify(tc.receipt, tc.issuer); err == nil {
+			t.Errorf("%s: receipt verified", name)
+		}
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	if _, err := ParseJWKS([]byte(`{"keys":[]}`)); err == nil {
+		t.Error("empty JWKS parsed")
+	}
+
+	bad := JWKS{Keys: []JWK{{Kty: "EC", Crv: "P-256", X: "AAAA", Y: "AAAA", Kid: "bad"}}}
+	claims := Claims{Key: "k", StandardClaims: jwt.StandardClaims{Issuer: DefaultIssuer}}
+	token := jwt.NewWithClaims(signingMethod, claims)
+	token.Header["kid"] = "bad"
+	signed, err := token.SignedString(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.Verify(signed, DefaultIssuer); err == nil {
+		t.Error("receipt verified against a key that isn't on the curve")
+	}
+}
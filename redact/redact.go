@@ -0,0 +1,192 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Placeholder is what every redacted value is replaced with
+const Placeholder = "[REDACTED]"
+
+// These are always scrubbed, on top of whatever fields are configured
+var defaultFields = []string{
+	"passcode",
+	"skey",
+	"secret",
+	"password",
+	"token",
+	// Whoever has an enrollment's activation code can activate it
+	"activationCode",
+	"activation_code",
+}
+
+// A Redactor scrubs secrets out of log fields, access logs and error messages
+type Redactor struct {
+	secrets []string
+	fields  map[string]bool
+
+	// Matches field=value pairs in query strings and pushinfo
+	paramRe *regexp.Regexp
+	// Matches "field": "value" pairs in JSON
+	jsonRe *regexp.Regexp
+}
+
+// New returns a Redactor which replaces any literal occurrence of secrets, and the value of
+// any field named in fields (case-insensitively), with Placeholder
+func New(secrets []string, fields []string) *Redactor {
+	r := Redactor{
+		fields: make(map[string]bool),
+	}
+
+	for _, s := range secrets {
+		if s != "" {
+			r.secrets = append(r.secrets, s)
+		}
+	}
+
+	var names []string
+	for _, f := range append(defaultFields, fields...) {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" || r.fields[f] {
+			continue
+		}
+		r.fields[f] = true
+		names = append(names, regexp.QuoteMeta(f))
+	}
+
+	alt := strings.Join(names, "|")
+	r.paramRe = regexp.MustCompile(`(?i)((?:^|[?&;\s"'])(?:` + alt + `)=)[^&;\s"']*`)
+	r.jsonRe = regexp.MustCompile(`(?i)("(?:` + alt + `)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+	return &r
+}
+
+// IsSensitive returns whether values stored under the given field name should be redacted
+func (r *Redactor) IsSensitive(field string) bool {
+	return r.fields[strings.ToLower(field)]
+}
+
+// String returns s with all known secrets and sensitive field values replaced
+func (r *Redactor) String(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, Placeholder, -1)
+	}
+	s = r.paramRe.ReplaceAllString(s, "${1}"+Placeholder)
+	s = r.jsonRe.ReplaceAllString(s, `${1}"`+Placeholder+`"`)
+	return s
+}
+
+// Fields returns a copy of fields with sensitive values replaced, including inside maps, slices and structs
+func (r *Redactor) Fields(fields log.Fields) log.Fields {
+	scrubbed := make(log.Fields, len(fields))
+	for k, v := range fields {
+		if r.IsSensitive(k) {
+			scrubbed[k] = Placeholder
+			continue
+		}
+		scrubbed[k] = r.value(v)
+	}
+	return scrubbed
+}
+
+// value returns v with sensitive values replaced.  Numbers and bools are kept as they are, maps and slices are
+// copied with their values scrubbed, and anything else is rendered as a string (as JSON for structs) and scrubbed.
+func (r *Redactor) value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return r.String(val)
+	case error:
+		return r.String(val.Error())
+	case fmt.Stringer:
+		return r.String(val.String())
+	case []byte:
+		return r.String(string(val))
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v
+	case reflect.Map:
+		m := make(map[string]interface{}, rv.Len())
+		for _, key := range rv.MapKeys() {
+			name := fmt.Sprint(key.Interface())
+			if r.IsSensitive(name) {
+				m[name] = Placeholder
+				continue
+			}
+			m[name] = r.value(rv.MapIndex(key).Interface())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = r.value(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Struct, reflect.Ptr:
+		// Field names in JSON are what jsonRe knows how to find
+		if b, err := json.Marshal(v); err == nil {
+			return r.String(string(b))
+		}
+	}
+	return r.String(fmt.Sprintf("%+v", v))
+}
+
+// Levels implements logrus.Hook, the redactor applies to every level
+func (r *Redactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook, scrubbing the entry before it's formatted
+func (r *Redactor) Fire(entry *log.Entry) error {
+	// The entry's Data may be shared with its parent, so never modify it in place
+	entry.Data = r.Fields(entry.Data)
+	entry.Message = r.String(entry.Message)
+	return nil
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+// Writer wraps w so that everything written through it is redacted first.
+// Each call to Write is expected to be a complete line, as written by echo's access logger.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	_, err := io.WriteString(w.w, w.r.String(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	// Report the original length, callers don't care how long the redacted line was
+	return len(p), nil
+}
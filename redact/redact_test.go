@@ -0,0 +1,144 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestString(t *testing.T) {
+	r := New([]string{"s3cr3t-skey"}, []string{"apiKey"})
+
+	for name, tc := range map[string]struct {
+		in, want string
+	}{
+		"query param":         {"/v1/passcode/k?user=alice&passcode=123456", "/v1/passcode/k?user=alice&passcode=[REDACTED]"},
+		"first query param":   {"passcode=123456&user=alice", "passcode=[REDACTED]&user=alice"},
+		"case insensitive":    {"/v1/x?PassCode=123456", "/v1/x?PassCode=[REDACTED]"},
+		"configured field":    {"?apikey=abc&user=alice", "?apikey=[REDACTED]&user=alice"},
+		"not a field":         {"?mypasscode=123456", "?mypasscode=123456"},
+		"empty value":         {"?passcode=&user=alice", "?passcode=[REDACTED]&user=alice"},
+		"json":                {`{"user": "alice", "passcode": "123456"}`, `{"user": "alice", "passcode": "[REDACTED]"}`},
+		"json escaped quotes": {`{"token":"a\"b"}`, `{"token":"[REDACTED]"}`},
+		"json activation":     {`{"activationCode":"xyz","user":"alice"}`, `{"activationCode":"[REDACTED]","user":"alice"}`},
+		"skey anywhere":       {"signing with s3cr3t-skey failed", "signing with [REDACTED] failed"},
+		"skey in a url":       {"https://host/?x=s3cr3t-skey", "https://host/?x=[REDACTED]"},
+		"nothing sensitive":   {"user=alice&key=deploy", "user=alice&key=deploy"},
+		"spaces around field": {`password=hunter2 user=alice`, `password=[REDACTED] user=alice`},
+		"secret in json body": {`{"secret": "JBSWY3DP"}`, `{"secret": "[REDACTED]"}`},
+	} {
+		if got := r.String(tc.in); got != tc.want {
+			t.Errorf("%s: got %q, want %q", name, got, tc.want)
+		}
+	}
+}
+
+type payload struct {
+	User     string `json:"user"`
+	Passcode string `json:"passcode"`
+}
+
+type named string
+
+func (n named) String() string {
+	return string(n)
+}
+
+func TestFields(t *testing.T) {
+	r := New([]string{"s3cr3t-skey"}, []string{"ssn"})
+
+	fields := log.Fields{
+		"passcode": "123456",
+		"SSN":      "123-45-6789",
+		"user":     "alice",
+		"url":      "/v1/x?passcode=123456",
+		"err":      errors.New("bad skey s3cr3t-skey"),
+		"stringer": named("token=abc"),
+		"count":    3,
+		"ok":       true,
+		"metadata": map[string]string{"ssn": "123-45-6789", "repo": "x/y"},
+		"nested": map[string]interface{}{
+			"inner": map[string]string{"password": "hunter2"},
+			"list":  []string{"passcode=1", "fine"},
+		},
+		"payload": &payload{User: "alice", Passcode: "123456"},
+		"bytes":   []byte("secret=abc"),
+	}
+	want := log.Fields{
+		"passcode": Placeholder,
+		"SSN":      Placeholder,
+		"user":     "alice",
+		"url":      "/v1/x?passcode=" + Placeholder,
+		"err":      "bad skey " + Placeholder,
+		"stringer": "token=" + Placeholder,
+		"count":    3,
+		"ok":       true,
+		"metadata": map[string]interface{}{"ssn": Placeholder, "repo": "x/y"},
+		"nested": map[string]interface{}{
+			"inner": map[string]interface{}{"password": Placeholder},
+			"list":  []interface{}{"passcode=" + Placeholder, "fine"},
+		},
+		"payload": `{"user":"alice","passcode":"` + Placeholder + `"}`,
+		"bytes":   "secret=" + Placeholder,
+	}
+
+	got := r.Fields(fields)
+	for k := range want {
+		if !reflect.DeepEqual(got[k], want[k]) {
+			t.Errorf("%s: got %#v, want %#v", k, got[k], want[k])
+		}
+	}
+
+	// The fields passed in are left alone, they may be shared
+	if fields["passcode"] != "123456" || fields["metadata"].(map[string]string)["ssn"] != "123-45-6789" {
+		t.Error("fields were scrubbed in place")
+	}
+}
+
+func TestHook(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Formatter = &log.JSONFormatter{}
+	logger.Hooks.Add(New(nil, nil))
+
+	logger.WithField("metadata", map[string]string{"passcode": "123456"}).Info("called /v1/x?passcode=654321")
+	if out := buf.String(); strings.Contains(out, "123456") || strings.Contains(out, "654321") {
+		t.Errorf("passcode was logged: %s", out)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := New(nil, nil).Writer(&buf)
+
+	line := `{"uri":"/v1/passcode/k?passcode=123456&user=alice","status":200}` + "\n"
+	n, err := w.Write([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(line) {
+		t.Errorf("expected the original length %d to be reported, got %d", len(line), n)
+	}
+	if want := `{"uri":"/v1/passcode/k?passcode=` + Placeholder + `&user=alice","status":200}` + "\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
@@ -15,121 +15,229 @@
 package server
 
 import (
+	"context"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/mfa"
 	"github.com/palantir/duo-bot/state"
+	"github.com/palantir/duo-bot/tracing"
 )
 
 const (
 	// We'll probably never hit this - this is just here in case we have an I/O issue in our long-poll
 	// to DUO's auth_status endpoint, because DUO should timeout in 60s
 	asyncTimeout = 70 * time.Second
+
+	// How long to leave a transaction DUO says is still waiting before asking about it again
+	pollInterval = time.Second
+
+	// auth_status long-polls until the user answers, so a worker only waits this long on it before putting the
+	// transaction back on the queue, so a few slow users can't hold up every worker
+	maxPollWait = 5 * time.Second
+
+	// How long DUO gives a user to answer a push before the transaction times out on DUO's end
+	duoTxnWindow = 60 * time.Second
 )
 
 type duoTXNTracker struct {
 	key    string
-	txnid  string
-	ts     time.Time
+	user   string
+	factor string
+	// The MFA provider the transaction is with
+	provider mfa.Provider
+	txnid    string
+	ts       time.Time
+	// When txnid was sent, which is later than ts for fallbacks
+	sent time.Time
+	// Factors to fall back to in order if the user doesn't answer, see fallBack
+	fallback []string
+	// The factor the prompt was first sent with, if it's since fallen back
+	firstFactor string
+	// Shown to the user by fallbacks, if set
+	displayUsername string
+	pushInfo        map[string]string
+	binding         *state.Binding
+	req             *requestInfo
+	// The span of the request that created this tracker, which it'll outlive
+	parent tracing.SpanContext
 	logger *log.Entry
 	server *Server
+
+	// We stop asking DUO about the transaction after this
+	deadline time.Time
+	// Don't ask DUO about the transaction again before this
+	nextPoll time.Time
+
+	ctx  context.Context
+	span *tracing.Span
+}
+
+// authStatusResult is one answer from auth_status
+type authStatusResult struct {
+	status state.PromptStatus
+	// The provider's own status, e.g. DUO's allow, deny, fraud or locked_out
+	duoStatus string
 }
 
-func (s *Server) newDuoTXNTracker(key string, txnid string, ts time.Time, logger *log.Entry) *duoTXNTracker {
+func (s *Server) newDuoTXNTracker(key string, user string, factor string, provider mfa.Provider, txnid string, ts time.Time, req *requestInfo, parent tracing.SpanContext, logger *log.Entry) *duoTXNTracker {
 	logger = logger.WithFields(log.Fields{
 		"TXNID": txnid,
 	})
 
 	d := duoTXNTracker{
-		key:    key,
-		txnid:  txnid,
-		ts:     ts,
-		logger: logger,
-		server: s,
+		key:      key,
+		user:     user,
+		factor:   factor,
+		provider: provider,
+		txnid:    txnid,
+		ts:       ts,
+		sent:     ts,
+		req:      req,
+		parent:   parent,
+		logger:   logger,
+		server:   s,
+		deadline: ts.Add(asyncTimeout),
 	}
 
 	return &d
 }
 
-func (d *duoTXNTracker) asyncHelper() {
-	ok := d.waitForAuth()
-	if ok {
-		d.logger.Debug("Got success from DUO, attempting to mark prompt as success")
-		err := d.server.state[d.key].TryAllow(d.ts)
-		if err != nil {
-			d.logger.Error(err)
-		}
-	} else {
-		d.logger.Debug("Got deny from DUO, marking prompt as deny")
-		d.server.state[d.key].Deny()
+// pending is what's needed to pick d back up after a restart
+func (d *duoTXNTracker) pending() state.PendingTxn {
+	return state.PendingTxn{
+		Key:      d.key,
+		User:     d.user,
+		Factor:   d.factor,
+		Provider: d.provider.Name(),
+		TxID:     d.txnid,
+		Created:  d.ts,
+		Sent:     d.sent,
+		Fallback: d.fallback,
+
+		DisplayUsername: d.displayUsername,
+		Metadata:        d.pushInfo,
+		Binding:         d.binding,
+		RequestID:       d.req.id,
+		Client:          d.req.client,
+		SourceIP:        d.req.sourceIP,
 	}
 }
 
-func (d *duoTXNTracker) waitForAuth() bool {
-	timer := time.NewTimer(asyncTimeout)
-	resChan := make(chan state.PromptStatus)
+// begin starts the span covering the whole time d is tracked
+func (d *duoTXNTracker) begin() {
+	// Not the request's context, that's cancelled as soon as the request returns, but the trackers' one, which
+	// is cancelled once the shutdown grace period is over
+	d.ctx, d.span = d.server.tracer.Start(tracing.ContextWithParent(d.server.trackers.ctx, d.parent), "duo.txn_tracker", tracing.KindInternal)
+	d.span.SetAttribute("duo.txid", d.txnid)
+	d.span.SetAttribute("duo.factor", d.factor)
+	d.span.SetAttribute("mfa.provider", d.provider.Name())
+}
 
-	defer timer.Stop()
+// abandon stops tracking d before DUO answered, because we're shutting down.
+// The prompt stays pending for the next start to pick up.
+func (d *duoTXNTracker) abandon() {
+	d.logger.Warn("Shutting down before DUO answered, leaving prompt pending")
+	d.span.SetAttribute("duo.unfinished", true)
+	d.span.End()
+}
 
-	go d.authStatus(resChan)
+// poll asks the provider once how the transaction is going, returning whether it rate limited us instead of answering
+func (d *duoTXNTracker) poll() (authStatusResult, bool) {
+	d.logger.Debug("Polling MFA provider for the transaction's status")
+	ctx, cancel := context.WithTimeout(d.ctx, maxPollWait)
+	defer cancel()
 
-	// Keep trying until we're timed out or got a result or got an error
-	for {
-		select {
-		case <-timer.C:
-			d.logger.Error("Timed-out waiting for auth_status to return")
-			return false
-		case curRes := <-resChan:
-			if curRes == state.StatusPending {
-				d.logger.Debug("Still waiting in waitForAuth")
-				continue
-			}
+	res, err := d.provider.Poll(ctx, d.txnid)
+	// Either the user hasn't answered yet, or we're shutting down and it's left pending
+	if err != nil && ctx.Err() != nil {
+		return authStatusResult{status: state.StatusPending}, false
+	}
+	if mfa.IsRateLimited(err) {
+		d.logger.Warn(errors.Wrap(err, "Rate limited checking auth status"))
+		return authStatusResult{status: state.StatusPending}, true
+	}
+	// The provider being down doesn't mean the user said no, keep asking until the transaction's deadline
+	if mfa.IsUnavailable(err) {
+		d.logger.Warn(errors.Wrap(err, "MFA provider unavailable checking auth status, will try again"))
+		return authStatusResult{status: state.StatusPending}, false
+	}
+	if err != nil {
+		d.logger.Error(errors.Wrap(err, "Error checking auth status"))
+		return authStatusResult{status: state.StatusDenied}, false
+	}
 
-			return curRes == state.StatusAllowed
-		}
+	switch res.Status {
+	case mfa.StatusAllowed:
+		// The only true condition - the async request has been accepted
+		return authStatusResult{status: state.StatusAllowed, duoStatus: res.ProviderStatus}, false
+	case mfa.StatusWaiting:
+		// We're waiting, but haven't been rejected yet
+		d.logger.Infof("Got waiting for reason '%s' from auth_status", res.Message)
+		return authStatusResult{status: state.StatusPending, duoStatus: res.ProviderStatus}, false
+	default:
+		// Fail closed, an explicit deny whould hit this
+		return authStatusResult{status: state.StatusDenied, duoStatus: res.ProviderStatus}, false
 	}
 }
 
-// This function will "long-poll" to mimic how the DUO endpoint we're querying works
-// that is, something will be put onto the resChan only when I get something new returned from duo.AuthStatus
-func (d *duoTXNTracker) authStatus(resChan chan state.PromptStatus) {
-	for {
-		log.Debug("Initiating call to DUO's auth_status endpoint")
-		res, err := d.server.duo.AuthStatus(d.txnid)
-		if err != nil {
-			resChan <- state.StatusDenied
-			d.logger.Error(errors.Wrap(err, "Error checking DUO auth status"))
-			return
-		}
-
-		if res == nil {
-			resChan <- state.StatusDenied
-			d.logger.Error(errors.New("empty response from auth_status"))
-			return
-		}
+// finish records how the transaction ended, allowing or denying the prompt
+func (d *duoTXNTracker) finish(res authStatusResult) {
+	defer d.span.End()
+	d.span.SetAttribute("duo.status", res.duoStatus)
+
+	if res.status == state.StatusTimedOut {
+		d.logger.Error("Timed-out waiting for auth_status to return")
+		d.span.SetAttribute("duo.allowed", false)
+		d.server.audit(d.req, audit.Event{
+			Type:   audit.EventDuoResponse,
+			Key:    d.key,
+			User:   d.user,
+			TxID:   d.txnid,
+			Factor: d.factor,
+			Result: "timeout",
+		})
+		d.server.getPrompt(d.key).TimeOut()
+		d.server.transition(d.req, d.key, d.user, d.factor, state.StatusTimedOut, "")
+		return
+	}
 
-		if res.Stat != "OK" {
-			resChan <- state.StatusDenied
-			d.logger.Error(errors.Errorf("Error reported by auth_status: %s", res.Response.Status_Msg))
-			return
-		}
+	ok := res.status == state.StatusAllowed
+	d.span.SetAttribute("duo.allowed", ok)
 
-		// The only true condition - the async request has been accepted
-		if res.Response.Result == "allow" {
-			resChan <- state.StatusAllowed
-			return
-		}
+	result := "deny"
+	if ok {
+		result = "allow"
+	}
+	meta := map[string]string{"duoStatus": res.duoStatus}
+	if d.firstFactor != "" {
+		meta["firstFactor"] = d.firstFactor
+	}
+	d.server.audit(d.req, audit.Event{
+		Type:     audit.EventDuoResponse,
+		Key:      d.key,
+		User:     d.user,
+		TxID:     d.txnid,
+		Factor:   d.factor,
+		Result:   result,
+		Metadata: meta,
+	})
 
-		// We're waiting, but haven't been rejected yet
-		if res.Response.Result == "waiting" {
-			d.logger.Infof("Got waiting for reason '%s' from auth_status", res.Response.Status_Msg)
-			resChan <- state.StatusPending
-		} else {
-			// Fail closed, an explicit deny whould hit this
-			resChan <- state.StatusDenied
+	if ok {
+		d.logger.Debug("Got success from DUO, attempting to mark prompt as success")
+		err := d.server.getPrompt(d.key).TryAllow(d.ts, d.factor)
+		if err != nil {
+			d.logger.Error(err)
+			d.server.transition(d.req, d.key, d.user, d.factor, state.StatusDenied, err.Error())
 			return
 		}
+		d.server.transition(d.req, d.key, d.user, d.factor, state.StatusAllowed, "")
+	} else {
+		d.logger.Debug("Got deny from DUO, marking prompt as deny")
+		d.server.getPrompt(d.key).Deny()
+		d.server.transition(d.req, d.key, d.user, d.factor, state.StatusDenied, "")
 	}
 }
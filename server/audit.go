@@ -0,0 +1,107 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/twinj/uuid"
+
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/redact"
+	"github.com/palantir/duo-bot/state"
+)
+
+// requestInfo is who is asking for something, carried along so everything done on their behalf
+// (including async work that outlives the request) can be audited
+type requestInfo struct {
+	id string
+	// From the client header, only if a trusted proxy set it, so anyone can't claim to be anyone
+	client   string
+	sourceIP string
+	// Whether the request is prompting with the break-glass provider
+	breakGlass bool
+}
+
+func (s *Server) newRequestInfo(c echo.Context) *requestInfo {
+	req := requestInfo{
+		id:       uuid.NewV4().String(),
+		sourceIP: s.clientIP(c.Request()),
+	}
+	if s.fromTrustedProxy(c.Request()) {
+		req.client = c.Request().Header.Get(s.clientHeader)
+	} else if claimed := c.Request().Header.Get(s.clientHeader); claimed != "" {
+		log.Debugf("Ignoring %s '%s' from %s, which isn't a trusted proxy", s.clientHeader, claimed, c.Request().RemoteAddr)
+	}
+	return &req
+}
+
+// ipAddr returns the request's source IP if it's one the MFA provider will accept, or nothing
+func (r *requestInfo) ipAddr() string {
+	if net.ParseIP(r.sourceIP) == nil {
+		return ""
+	}
+	return r.sourceIP
+}
+
+// audit records e on behalf of req, if auditing is enabled.  Failing to audit is logged loudly,
+// but doesn't fail the request.
+func (s *Server) audit(req *requestInfo, e audit.Event) {
+	if s.auditLog == nil {
+		return
+	}
+
+	e.Client = req.client
+	e.SourceIP = req.sourceIP
+	e.RequestID = req.id
+	e.BreakGlass = e.BreakGlass || req.breakGlass
+	e.Message = s.redact.String(e.Message)
+
+	for k, v := range e.Metadata {
+		if s.redact.IsSensitive(k) {
+			e.Metadata[k] = redact.Placeholder
+		} else {
+			e.Metadata[k] = s.redact.String(v)
+		}
+	}
+
+	if err := s.auditLog.Record(e); err != nil {
+		log.WithFields(log.Fields{
+			"key":       e.Key,
+			"requestID": req.id,
+			"type":      e.Type,
+		}).Error(errors.Wrap(err, "Error writing to audit log"))
+	}
+}
+
+// transition records a prompt on key moving to status, in the audit log and in metrics
+func (s *Server) transition(req *requestInfo, key string, user string, factor string, status state.PromptStatus, msg string) {
+	// Awaiting a passcode is only on the way to allowed or denied, which is what's counted
+	if status != state.StatusAwaitingPasscode {
+		s.metrics.prompts.Inc(factor, status.String())
+	}
+
+	s.audit(req, audit.Event{
+		Type:    audit.EventStateTransition,
+		Key:     key,
+		User:    user,
+		Factor:  factor,
+		Result:  status.String(),
+		Message: msg,
+	})
+}
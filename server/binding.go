@@ -0,0 +1,59 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/state"
+)
+
+// bindParamPrefix prefixes the query params a check presents a bound approval's context in, e.g. metadata.repo
+const bindParamPrefix = "metadata."
+
+// binding returns the context a prompt in ns is bound to, from its metadata and the calling client, or nil if ns
+// doesn't bind approvals
+func (ns Namespace) binding(metadata map[string]string, client string) (*state.Binding, error) {
+	if len(ns.Bind) == 0 && !ns.BindClient {
+		return nil, nil
+	}
+
+	fields := make(map[string]string, len(ns.Bind))
+	for _, name := range ns.Bind {
+		value, ok := metadata[name]
+		if !ok {
+			return nil, errors.Errorf("metadata field '%s' is needed, approvals for keys in namespace %s are bound to it", name, ns.Name)
+		}
+		fields[name] = value
+	}
+	if ns.BindClient && client == "" {
+		return nil, errors.Errorf("approvals for keys in namespace %s are bound to the calling client, but it's unknown or wasn't set by a trusted proxy", ns.Name)
+	}
+	return state.NewBinding(fields, client, ns.BindClient), nil
+}
+
+// presentedContext returns the context a check presents, from its metadata.<field> query params
+func presentedContext(c echo.Context) map[string]string {
+	presented := make(map[string]string)
+	for name, values := range c.QueryParams() {
+		if strings.HasPrefix(name, bindParamPrefix) && len(values) > 0 {
+			presented[strings.TrimPrefix(name, bindParamPrefix)] = values[0]
+		}
+	}
+	return presented
+}
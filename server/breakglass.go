@@ -0,0 +1,94 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+// BreakGlassPolicy restricts who can prompt with a break-glass provider, for when the usual one is down
+type BreakGlassPolicy struct {
+	// Name of the break-glass provider, no provider is break-glass if this is empty
+	Provider string
+	// The only users who may prompt with the provider
+	Users []string
+	// The only namespaces the provider may be used in, including "default" for keys in no namespace
+	Namespaces []string
+}
+
+func (p *BreakGlassPolicy) allows(user string, namespace string) bool {
+	return contains(p.Users, user) && contains(p.Namespaces, namespace)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBreakGlass checks policy only refers to providers and namespaces that exist
+func (s *Server) validateBreakGlass(policy BreakGlassPolicy) error {
+	if policy.Provider == "" {
+		return nil
+	}
+	if _, ok := s.providers[policy.Provider]; !ok {
+		return errors.Errorf("break-glass provider '%s' is not configured", policy.Provider)
+	}
+	for _, name := range policy.Namespaces {
+		if name == defaultNamespace {
+			continue
+		}
+		found := false
+		for _, ns := range s.namespaces {
+			found = found || ns.Name == name
+		}
+		if !found {
+			return errors.Errorf("break-glass namespace '%s' is not configured", name)
+		}
+	}
+
+	s.breakGlass = policy
+	return nil
+}
+
+// isBreakGlass returns whether provider is the break-glass provider
+func (s *Server) isBreakGlass(provider string) bool {
+	return s.breakGlass.Provider != "" && provider == s.breakGlass.Provider
+}
+
+// chooseProvider returns which provider to prompt user with for a key in ns, the namespace's own
+// unless they asked for another.  Only the break-glass provider can be asked for, and only
+// by break-glass users in break-glass namespaces.
+func (s *Server) chooseProvider(ns Namespace, user string, requested string) (string, error) {
+	name := ns.Provider
+	if requested != "" {
+		name = requested
+	}
+
+	if s.isBreakGlass(name) {
+		if !s.breakGlass.allows(user, ns.Name) {
+			return name, errors.Errorf("%s may not use break-glass provider %s in namespace %s\n", user, name, ns.Name)
+		}
+		return name, nil
+	}
+
+	if name != ns.Provider {
+		return name, errors.Errorf("namespace %s prompts with %s, only the break-glass provider can be asked for instead\n", ns.Name, ns.Provider)
+	}
+	return name, nil
+}
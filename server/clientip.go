@@ -0,0 +1,105 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedProxies are the networks of proxies whose X-Forwarded-For is believed
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses CIDRs, or bare IPs for a single proxy
+func parseTrustedProxies(list []string) (trustedProxies, error) {
+	var t trustedProxies
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("trusted proxy '%s' is neither an IP nor a CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			t = append(t, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "trusted proxy '%s' is neither an IP nor a CIDR", entry)
+		}
+		t = append(t, network)
+	}
+	return t, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy returns whether r came straight from one of the trusted proxies, so headers they set can be believed
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	ip := net.ParseIP(peer)
+	return ip != nil && s.trustedProxies.contains(ip)
+}
+
+// clientIP returns the address of whoever made r.  X-Forwarded-For is only believed as far back as it was
+// added by trusted proxies: the client is the last hop added by a proxy we don't trust.
+func (s *Server) clientIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	var hops []string
+	for _, header := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(client)
+		if ip == nil || !s.trustedProxies.contains(ip) {
+			break
+		}
+		// Anything unparseable is as far back as we can go
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		client = hops[i]
+	}
+
+	return client
+}
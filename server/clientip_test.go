@@ -0,0 +1,65 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: proxies}
+
+	for name, tc := range map[string]struct {
+		peer string
+		xff  []string
+		want string
+	}{
+		"no header":              {"203.0.113.5:1234", nil, "203.0.113.5"},
+		"untrusted peer":         {"203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		"trusted peer":           {"10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		"trusted bare IP":        {"192.0.2.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		"spoofed leading hop":    {"10.1.2.3:1234", []string{"127.0.0.1, 198.51.100.7"}, "198.51.100.7"},
+		"chain of proxies":       {"10.1.2.3:1234", []string{"198.51.100.7, 10.4.5.6"}, "198.51.100.7"},
+		"spoof behind proxies":   {"10.1.2.3:1234", []string{"10.9.9.9, 198.51.100.7, 10.4.5.6"}, "198.51.100.7"},
+		"split across headers":   {"10.1.2.3:1234", []string{"198.51.100.7", "10.4.5.6"}, "198.51.100.7"},
+		"all trusted":            {"10.1.2.3:1234", []string{"10.4.5.6"}, "10.4.5.6"},
+		"unparseable hop":        {"10.1.2.3:1234", []string{"not-an-ip"}, "10.1.2.3"},
+		"unparseable behind one": {"10.1.2.3:1234", []string{"not-an-ip, 10.4.5.6"}, "10.4.5.6"},
+		"empty hops":             {"10.1.2.3:1234", []string{" , 198.51.100.7,"}, "198.51.100.7"},
+		"IPv6 peer":              {"[2001:db8::1]:1234", []string{"198.51.100.7"}, "2001:db8::1"},
+		"peer with no port":      {"10.1.2.3", []string{"198.51.100.7"}, "198.51.100.7"},
+	} {
+		r := &http.Request{RemoteAddr: tc.peer, Header: http.Header{}}
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %s, want %s", name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, entry := range []string{"", "10.0.0.0/33", "proxy.example.com"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("expected '%s' to be refused", entry)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/mfa"
+)
+
+// devicesPayload is what a provider knows about a user's devices
+type devicesPayload struct {
+	User     string `json:"user"`
+	Provider string `json:"provider"`
+	// The provider's preauth result, e.g. auth, allow, deny or enroll
+	Status    string       `json:"status"`
+	Message   string       `json:"message,omitempty"`
+	EnrollURL string       `json:"enrollURL,omitempty"`
+	Devices   []mfa.Device `json:"devices"`
+}
+
+// devicesHandler lists the devices a user can be prompted on, for picking a device= to prompt with
+func (s *Server) devicesHandler(c echo.Context) error {
+	req := s.newRequestInfo(c)
+	user, err := s.canonicalUser(s.defaultIdentity, c.Param("user"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	logger := getLogger(req.id, "", user)
+
+	name := c.QueryParam("provider")
+	if name == "" {
+		name = s.defaultProvider
+	}
+	provider, ok := s.providers[name]
+	if !ok {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Unknown MFA provider %s\n", name))
+	}
+
+	ctx := c.Request().Context()
+	payload := devicesPayload{User: user, Provider: name, Status: preauthAuth}
+	payload.Devices, err = provider.ListDevices(ctx, user)
+	// Users with no devices are bypassed, denied or not enrolled, so ask which
+	var pr *mfa.PreflightResult
+	if err == nil && len(payload.Devices) == 0 {
+		pr, err = provider.Preflight(ctx, mfa.PreflightRequest{User: user, IPAddr: req.ipAddr()})
+	}
+	if err != nil {
+		msg := errors.Wrap(err, "Error listing devices")
+		logger.Error(msg)
+		if mfa.IsUnavailable(err) {
+			return c.String(http.StatusServiceUnavailable, "MFA provider is unavailable, try again later\n")
+		}
+		return c.String(http.StatusBadGateway, s.redact.String(msg.Error()))
+	}
+	if payload.Devices == nil {
+		payload.Devices = []mfa.Device{}
+	}
+	if pr == nil {
+		return c.JSON(http.StatusOK, payload)
+	}
+
+	payload.Status = pr.Result
+	payload.Message = pr.Message
+	// Whoever opens the enrollment portal can enroll a device for user
+	if s.actsFor(req, user) {
+		payload.EnrollURL = pr.EnrollURL
+	}
+	return c.JSON(http.StatusOK, payload)
+}
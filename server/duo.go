@@ -15,26 +15,55 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"net/url"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/duosecurity/duo_api_golang/authapi"
 	"github.com/pkg/errors"
-)
 
-const (
-	// Arbitrary string to display in push notifications as the type
-	// https://duo.com/docs/authapi#/auth (see type under Duo Push)
-	duoAuthType = "Transaction"
+	"github.com/palantir/duo-bot/mfa"
 )
 
+// A denyError is the MFA provider explicitly refusing a prompt, as opposed to us failing to talk to it
+type denyError struct {
+	// The provider's status for the refusal, e.g. deny, fraud or locked_out
+	status string
+	msg    string
+	// Whether the user could be prompted, just not with the factor or device asked for
+	factorUnavailable bool
+}
+
+func (e *denyError) Error() string {
+	return fmt.Sprintf("Prompt failed: %s\n", e.msg)
+}
+
+// duoStatus returns the provider's status for a refused prompt, if err is one
+func duoStatus(err error) string {
+	if de, ok := errors.Cause(err).(*denyError); ok {
+		return de.status
+	}
+	return ""
+}
+
 type promptConfig struct {
 	user     string
 	factor   string
 	device   string
 	passcode string
 	async    bool
+
+	// Passed on to the provider for its policies and to show the user, both optional
+	ipAddr          string
+	displayUsername string
+	// Extra key/value pairs from the caller to show the user
+	pushInfo map[string]string
+	// What the push shows the user, see renderPush
+	pushType   string
+	pushFields []mfa.PushField
+
+	// Whether the caller is the user or an admin, who can be told where to enroll the user
+	actsForUser bool
 }
 
 func newPromptConfig(user string, factor string, device string, passcode string, async bool) (*promptConfig, error) {
@@ -64,90 +93,65 @@ func newPromptConfig(user string, factor string, device string, passcode string,
 	return &pc, nil
 }
 
-func (s *Server) newDuoAuth(pc *promptConfig, key string, meta *MetadataPayload) (*authapi.AuthResult, error) {
-	log.WithFields(log.Fields{
-		"factor":   pc.factor,
-		"username": pc.user,
-		"passcode": pc.passcode,
-		"device":   pc.device,
-		"async":    pc.async,
-	}).Debug("Issuing DUO call")
-
-	var options []func(*url.Values)
-
-	// Everything needs username
-	options = append(options, authapi.AuthUsername(pc.user))
-
+// prompt challenges the user through provider, returning the result unless the provider refused the prompt
+func (s *Server) prompt(ctx context.Context, provider mfa.Provider, pc *promptConfig, key string) (*mfa.Result, error) {
+	var res *mfa.Result
+	var err error
 	if pc.factor == "passcode" {
-		options = append(options, authapi.AuthPasscode(pc.passcode))
-		return s.duo.Auth(pc.factor, options...)
+		res, err = provider.VerifyPasscode(ctx, mfa.PasscodeRequest{
+			User:     pc.user,
+			Passcode: pc.passcode,
+			IPAddr:   pc.ipAddr,
+		})
+	} else {
+		res, err = provider.Challenge(ctx, mfa.ChallengeRequest{
+			Key:      key,
+			User:     pc.user,
+			Factor:   pc.factor,
+			Device:   pc.device,
+			Async:    pc.async,
+			PushType: pc.pushType,
+			PushInfo: pc.pushFields,
+			IPAddr:   pc.ipAddr,
+
+			DisplayUsername: pc.displayUsername,
+		})
 	}
-
-	// Everything else involves a device, so needs at least that
-	options = append(options, authapi.AuthDevice(pc.device))
-
-	// phone and push can use this
-	if pc.async {
-		options = append(options, authapi.AuthAsync())
-	}
-
-	if pc.factor == "push" {
-		duoPushInfo := fmt.Sprintf("Key=%s", key)
-
-		if meta.DuoPushInfo != "" {
-			duoPushInfo = fmt.Sprintf("%s&%s", duoPushInfo, meta.DuoPushInfo)
-		}
-
-		options = append(options, authapi.AuthPushinfo(duoPushInfo), authapi.AuthType(duoAuthType))
-	}
-
-	return s.duo.Auth(pc.factor, options...)
-}
-
-func (s *Server) prompt(pc *promptConfig, key string, meta *MetadataPayload) (string, error) {
-	res, err := s.newDuoAuth(pc, key, meta)
 	if err != nil {
-		return "", errors.Wrap(err, "Error calling DUO")
-	}
-
-	// If the username specified doesn't exist
-	if res.Stat != "OK" {
-		return "", errors.Errorf("Error reported by DUO auth: %s\n", *res.Message)
+		return nil, err
 	}
 
-	// The only successful response from a blocking call
-	if res.Response.Status == "allow" {
-		return res.Response.Status_Msg, nil
+	switch {
+	case res.Status == mfa.StatusWaiting && res.TxID != "":
+		// We need this ID later to check status against
+		return res, nil
+	case res.Status == mfa.StatusAllowed, res.Status == mfa.StatusPasscodeSent:
+		return res, nil
+	default:
+		// Fail closed
+		return nil, &denyError{status: res.ProviderStatus, msg: res.Message}
 	}
-
-	// The only successful response from an async call
-	if res.Response.Txid != "" {
-		// Although the above case returns free-form text, this return is strict;
-		// we need this ID later to check status against
-		return res.Response.Txid, nil
-	}
-
-	// Fail closed
-	return "", errors.Errorf("Prompt failed: %s\n", res.Response.Status_Msg)
 }
 
-func (s *Server) duoCheck() error {
-	log.Info("Running initial DUO checks")
+// duoCheck makes sure we can reach DUO and that our credentials are good, returning how far ahead of DUO's clock ours is
+func (s *Server) duoCheck(ctx context.Context) (time.Duration, error) {
+	log.Debug("Running DUO checks")
 
-	_, err := s.duo.Ping()
+	pr, err := s.duoAPI.Ping(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Error pinging DUO Auth API")
+		return 0, errors.Wrap(err, "Error pinging DUO Auth API")
 	}
+	skew := time.Since(time.Unix(pr.Response.Time, 0))
 
-	cr, err := s.duo.Check()
+	cr, err := s.duoAPI.Check(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Error checking DUO Auth API")
+		return 0, errors.Wrap(err, "Error checking DUO Auth API")
 	}
 
 	// Like if the ikey/skey are bad
 	if cr.Stat != "OK" {
-		return errors.Errorf("Error checking DUO Auth API: %s", *cr.StatResult.Message)
+		return 0, errors.Errorf("Error checking DUO Auth API: %s", *cr.StatResult.Message)
 	}
 
-	return nil
+	return skew, nil
 }
@@ -0,0 +1,72 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/duosecurity/duo_api_golang/authapi"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/duoclient"
+	"github.com/palantir/duo-bot/tracing"
+)
+
+// duoObserver records metrics and a trace span for every call to DUO
+type duoObserver struct {
+	metrics *serverMetrics
+	tracer  *tracing.Tracer
+}
+
+// Observe starts timing and tracing a call to endpoint, returning a func to record how it went
+func (d *duoObserver) Observe(ctx context.Context, endpoint string) func(*authapi.StatResult, error) {
+	_, span := d.tracer.Start(ctx, "duo."+endpoint, tracing.KindClient)
+	span.SetAttribute("duo.endpoint", endpoint)
+	start := time.Now()
+
+	return func(stat *authapi.StatResult, err error) {
+		defer span.End()
+
+		// We stopped waiting, e.g. a long-poll cut off by maxPollWait, which says nothing about DUO
+		if err != nil && ctx.Err() != nil {
+			span.SetAttribute("duo.abandoned", true)
+			return
+		}
+
+		d.metrics.duoLatency.Observe(time.Since(start).Seconds(), endpoint)
+
+		if err != nil {
+			d.metrics.duoErrors.Inc(endpoint)
+			span.SetError(err)
+			return
+		}
+
+		if stat == nil || stat.Stat != "OK" {
+			d.metrics.duoErrors.Inc(endpoint)
+			span.SetError(errors.New("DUO returned a non-OK stat"))
+		}
+
+		if stat != nil {
+			span.SetAttribute("duo.stat", stat.Stat)
+			if stat.Code != nil {
+				span.SetAttribute("duo.code", int64(*stat.Code))
+				if *stat.Code == duoclient.RateLimitCode {
+					d.metrics.duoRateLimited.Inc(endpoint)
+				}
+			}
+		}
+	}
+}
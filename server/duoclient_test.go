@@ -0,0 +1,49 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestObserverIgnoresAbandonedCalls(t *testing.T) {
+	var s Server
+	s.metrics = s.newServerMetrics()
+	obs := &duoObserver{metrics: s.metrics}
+	errorsFor := func(endpoint string) bool {
+		var buf bytes.Buffer
+		if _, err := s.metrics.registry.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(buf.String(), `duobot_duo_errors_total{endpoint="`+endpoint+`"}`)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	obs.Observe(ctx, "auth_status")(nil, ctx.Err())
+	if errorsFor("auth_status") {
+		t.Error("a call we stopped waiting on was counted as a DUO error")
+	}
+
+	obs.Observe(context.Background(), "preauth")(nil, errors.New("connection refused"))
+	if !errorsFor("preauth") {
+		t.Error("a call that failed wasn't counted as a DUO error")
+	}
+}
@@ -0,0 +1,495 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/palantir/duo-bot/duotest"
+	"github.com/palantir/duo-bot/state"
+)
+
+// harness is a server in front of a fake DUO
+type harness struct {
+	t    *testing.T
+	fake *duotest.Server
+	s    *Server
+	srv  *httptest.Server
+}
+
+func newHarness(t *testing.T, cfg Config) *harness {
+	fake, err := duotest.NewServer("ikey", "skey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.Close)
+
+	cfg.Duo = fake.ClientConfig()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.poller.start(s.trackers.ctx)
+	t.Cleanup(s.trackers.cancel)
+
+	srv := httptest.NewServer(s.router())
+	t.Cleanup(srv.Close)
+
+	return &harness{t: t, fake: fake, s: s, srv: srv}
+}
+
+// do makes a request as client, if it's set, returning the status and body
+func (h *harness) do(method string, path string, client string, body string) (int, string) {
+	req, err := http.NewRequest(method, h.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client != "" {
+		req.Header.Set(defaultClientHeader, client)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func (h *harness) check(key string, user string) int {
+	status, _ := h.do("GET", "/v1/check/"+key+"?user="+user, "", "")
+	return status
+}
+
+// settled waits for the prompt on key to stop pending, returning how it settled
+func (h *harness) settled(key string, within time.Duration) state.PromptStatus {
+	deadline := time.Now().Add(within)
+	for {
+		p := h.s.getPrompt(key)
+		if p == nil {
+			h.t.Fatalf("no prompt for %s", key)
+		}
+		if status := p.Status(); status != state.StatusPending || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// auths counts the prompts sent to DUO, by factor
+func (h *harness) auths() map[string]int {
+	counts := make(map[string]int)
+	for _, r := range h.fake.Requests() {
+		if r.Path == "/auth/v2/auth" {
+			counts[r.Params.Get("factor")]++
+		}
+	}
+	return counts
+}
+
+func TestPushAndCheck(t *testing.T) {
+	h := newHarness(t, Config{})
+	h.fake.SetUser("alice", duotest.Allow)
+	h.fake.SetUser("bob", duotest.Deny)
+	h.fake.SetUser("carol", duotest.Bypass)
+	h.fake.SetUser("dave", duotest.LockedOut)
+
+	for user, tc := range map[string]struct {
+		push  int
+		check int
+	}{
+		"alice": {http.StatusOK, http.StatusOK},
+		"bob":   {http.StatusBadRequest, http.StatusInternalServerError},
+		"carol": {http.StatusOK, http.StatusOK},
+		"dave":  {http.StatusBadRequest, http.StatusInternalServerError},
+	} {
+		key := "key-" + user
+		if status, body := h.do("POST", "/v1/push/"+key+"?user="+user, "", ""); status != tc.push {
+			t.Errorf("%s: push returned %d, want %d: %s", user, status, tc.push, body)
+		}
+		if status := h.check(key, user); status != tc.check {
+			t.Errorf("%s: check returned %d, want %d", user, status, tc.check)
+		}
+	}
+
+	if status := h.check("key-alice", "bob"); status != http.StatusInternalServerError {
+		t.Errorf("check for another user returned %d", status)
+	}
+	if status := h.check("never-pushed", "alice"); status != http.StatusInternalServerError {
+		t.Errorf("check of a key that was never pushed returned %d", status)
+	}
+
+	// DUO let carol through and wouldn't let dave, so neither was prompted
+	if n := h.auths()["push"]; n != 2 {
+		t.Errorf("expected 2 pushes, got %d", n)
+	}
+}
+
+func TestAsyncPush(t *testing.T) {
+	h := newHarness(t, Config{})
+	h.fake.SetUser("alice", duotest.WaitingThenAllow)
+	h.fake.SetWaits(1)
+
+	if status, body := h.do("POST", "/v1/push/key?user=alice&async=1", "", ""); status != http.StatusOK {
+		t.Fatalf("async push returned %d: %s", status, body)
+	}
+	if status := h.check("key", "alice"); status != http.StatusInternalServerError {
+		t.Errorf("check before the user answered returned %d", status)
+	}
+	if status := h.settled("key", 10*time.Second); status != state.StatusAllowed {
+		t.Fatalf("async push settled %v", status)
+	}
+	if status := h.check("key", "alice"); status != http.StatusOK {
+		t.Errorf("check once the user approved returned %d", status)
+	}
+}
+
+// Users slower than a poll mustn't tie up the pollers, so the ones behind them are still polled
+func TestSlowUsersDontStarvePollers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits on slow users")
+	}
+
+	h := newHarness(t, Config{PollWorkers: 2})
+	h.fake.SetDefault(duotest.Allow)
+	h.fake.SetAnswerDelay(maxPollWait + time.Second)
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for _, key := range keys {
+		if status, body := h.do("POST", "/v1/push/"+key+"?user="+key+"&async=1", "", ""); status != http.StatusOK {
+			t.Fatalf("async push returned %d: %s", status, body)
+		}
+	}
+	for _, key := range keys {
+		if status := h.settled(key, 3*maxPollWait); status != state.StatusAllowed {
+			t.Errorf("%s settled %v", key, status)
+		}
+	}
+}
+
+func TestTrackersStopWhenCancelled(t *testing.T) {
+	h := newHarness(t, Config{})
+	h.fake.SetUser("alice", duotest.Allow)
+	h.fake.SetAnswerDelay(time.Minute)
+
+	if status, body := h.do("POST", "/v1/push/key?user=alice&async=1", "", ""); status != http.StatusOK {
+		t.Fatalf("async push returned %d: %s", status, body)
+	}
+	// Let the poll go out
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		h.s.trackers.wg.Wait()
+		close(done)
+	}()
+	h.s.trackers.cancel()
+
+	select {
+	case <-done:
+	case <-time.After(maxPollWait / 2):
+		t.Fatal("tracker didn't stop when the trackers were cancelled")
+	}
+	if status := h.s.getPrompt("key").Status(); status != state.StatusPending {
+		t.Errorf("abandoned prompt settled %v", status)
+	}
+}
+
+func fallbackHarness(t *testing.T) *harness {
+	h := newHarness(t, Config{
+		Namespaces: []Namespace{{Name: "fallback", Keys: []string{"fb-*"}, Fallback: []string{"push", "phone"}}},
+	})
+	h.fake.SetUser("alice", duotest.Timeout)
+	h.fake.SetWaits(0)
+	return h
+}
+
+func TestFallback(t *testing.T) {
+	h := fallbackHarness(t)
+
+	if status, body := h.do("POST", "/v1/push/fb-1?user=alice&async=1", "", ""); status != http.StatusOK {
+		t.Fatalf("async push returned %d: %s", status, body)
+	}
+	// The push is already out and goes unanswered, alice picks up the call
+	h.fake.SetUser("alice", duotest.Allow)
+
+	if status := h.settled("fb-1", 10*time.Second); status != state.StatusAllowed {
+		t.Fatalf("prompt settled %v", status)
+	}
+	if auths := h.auths(); auths["push"] != 1 || auths["phone"] != 1 {
+		t.Errorf("expected a push then a call, got %v", auths)
+	}
+	if approval, _ := h.s.getPrompt("fb-1").Approval(); approval.Factor != "phone" {
+		t.Errorf("expected the approval to be by phone, got %s", approval.Factor)
+	}
+}
+
+func TestFallbackSettledByPreauth(t *testing.T) {
+	for outcome, want := range map[duotest.Outcome]state.PromptStatus{
+		duotest.Bypass:    state.StatusAllowed,
+		duotest.LockedOut: state.StatusDenied,
+	} {
+		h := fallbackHarness(t)
+
+		if status, body := h.do("POST", "/v1/push/fb-1?user=alice&async=1", "", ""); status != http.StatusOK {
+			t.Fatalf("%s: async push returned %d: %s", outcome, status, body)
+		}
+		h.fake.SetUser("alice", outcome)
+
+		if status := h.settled("fb-1", 10*time.Second); status != want {
+			t.Errorf("%s: prompt settled %v, want %v", outcome, status, want)
+		}
+		if auths := h.auths(); auths["push"] != 1 || auths["phone"] != 0 {
+			t.Errorf("%s: expected DUO's answer to preauth to settle it without a call, got %v", outcome, auths)
+		}
+	}
+}
+
+func TestSMS(t *testing.T) {
+	h := newHarness(t, Config{PasscodeAttempts: 2})
+	h.fake.SetUserPasscode("alice", duotest.Allow, "111111")
+	h.fake.SetUser("bob", duotest.Allow)
+	passcode := func(key string, user string, code string) (int, string) {
+		return h.do("POST", "/v1/passcode/"+key+"?user="+user, "", `{"passcode": "`+code+`"}`)
+	}
+
+	if status, body := h.do("POST", "/v1/sms/ok?user=alice", "", ""); status != http.StatusOK {
+		t.Fatalf("sms returned %d: %s", status, body)
+	}
+	if status, body := passcode("ok", "alice", "111111"); status != http.StatusOK {
+		t.Fatalf("passcode returned %d: %s", status, body)
+	}
+	if status := h.check("ok", "alice"); status != http.StatusOK {
+		t.Errorf("check once the passcode was accepted returned %d", status)
+	}
+
+	if status, body := h.do("POST", "/v1/sms/key?user=alice", "", ""); status != http.StatusOK {
+		t.Fatalf("sms returned %d: %s", status, body)
+	}
+	// Someone else can't take over the prompt
+	if status, body := passcode("key", "bob", "123456"); status != http.StatusBadRequest {
+		t.Errorf("passcode from another user returned %d: %s", status, body)
+	}
+	if status := h.s.getPrompt("key").Status(); status != state.StatusAwaitingPasscode {
+		t.Fatalf("another user's passcode left the prompt %v", status)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, body := passcode("key", "alice", "000000"); status != http.StatusBadRequest {
+			t.Errorf("wrong passcode returned %d: %s", status, body)
+		}
+	}
+	if status := h.s.getPrompt("key").Status(); status != state.StatusDenied {
+		t.Fatalf("prompt is %v once out of attempts", status)
+	}
+
+	// Out of attempts, the right passcode mustn't start a new prompt that takes it
+	if status, body := passcode("key", "alice", "111111"); status != http.StatusBadRequest {
+		t.Errorf("passcode once out of attempts returned %d: %s", status, body)
+	}
+	if status := h.check("key", "alice"); status != http.StatusInternalServerError {
+		t.Errorf("check once out of attempts returned %d", status)
+	}
+	if n := h.auths()["passcode"]; n != 3 {
+		t.Errorf("expected only the 3 attempts allowed to reach DUO, got %d", n)
+	}
+}
+
+func TestSMSExpired(t *testing.T) {
+	h := newHarness(t, Config{PasscodeTTL: 50 * time.Millisecond})
+	h.fake.SetUser("alice", duotest.Allow)
+
+	if status, body := h.do("POST", "/v1/sms/key?user=alice", "", ""); status != http.StatusOK {
+		t.Fatalf("sms returned %d: %s", status, body)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if status, body := h.do("POST", "/v1/passcode/key?user=alice", "", `{"passcode": "123456"}`); status != http.StatusBadRequest {
+		t.Errorf("passcode once the passcodes expired returned %d: %s", status, body)
+	}
+	if n := h.auths()["passcode"]; n != 0 {
+		t.Errorf("expected no passcode to reach DUO once the passcodes expired, got %d", n)
+	}
+	if status := h.check("key", "alice"); status != http.StatusInternalServerError {
+		t.Errorf("check once the passcodes expired returned %d", status)
+	}
+}
+
+func TestBinding(t *testing.T) {
+	h := newHarness(t, Config{
+		Namespaces: []Namespace{{Name: "bound", Keys: []string{"b-*"}, Bind: []string{"repo"}}},
+	})
+	h.fake.SetUser("alice", duotest.Allow)
+
+	if status, body := h.do("POST", "/v1/push/b-1?user=alice", "", ""); status != http.StatusBadRequest {
+		t.Errorf("push without the bound metadata returned %d: %s", status, body)
+	}
+	if status, body := h.do("POST", "/v1/push/b-1?user=alice", "", `{"metadata": {"repo": "x/y"}}`); status != http.StatusOK {
+		t.Fatalf("push returned %d: %s", status, body)
+	}
+
+	if status, _ := h.do("GET", "/v1/check/b-1?user=alice&metadata.repo=x/y", "", ""); status != http.StatusOK {
+		t.Errorf("check in the approved context returned %d", status)
+	}
+
+	status, body := h.do("GET", "/v1/check/b-1?user=alice&metadata.repo=x/z", "", "")
+	if status != http.StatusInternalServerError {
+		t.Errorf("check in another context returned %d", status)
+	}
+	if !strings.Contains(body, "different repo") {
+		t.Errorf("expected the mismatch to be reported, got %s", body)
+	}
+}
+
+func TestBindClient(t *testing.T) {
+	namespaces := []Namespace{{Name: "bound", Keys: []string{"b-*"}, BindClient: true}}
+
+	// The client header can only be trusted from a trusted proxy
+	h := newHarness(t, Config{Namespaces: namespaces})
+	h.fake.SetUser("alice", duotest.Allow)
+	if status, body := h.do("POST", "/v1/push/b-1?user=alice", "ci", ""); status != http.StatusBadRequest {
+		t.Errorf("push with a client header from an untrusted proxy returned %d: %s", status, body)
+	}
+
+	h = newHarness(t, Config{Namespaces: namespaces, TrustedProxies: []string{"127.0.0.1"}})
+	h.fake.SetUser("alice", duotest.Allow)
+	if status, body := h.do("POST", "/v1/push/b-1?user=alice", "ci", ""); status != http.StatusOK {
+		t.Fatalf("push returned %d: %s", status, body)
+	}
+	if status, _ := h.do("GET", "/v1/check/b-1?user=alice", "ci", ""); status != http.StatusOK {
+		t.Errorf("check from the approved client returned %d", status)
+	}
+	if status, _ := h.do("GET", "/v1/check/b-1?user=alice", "laptop", ""); status != http.StatusInternalServerError {
+		t.Errorf("check from another client returned %d", status)
+	}
+}
+
+func TestGrants(t *testing.T) {
+	namespaces := []Namespace{{Name: "deploy", Keys: []string{"deploy-*"}, MaxGrant: "1h"}}
+	h := newHarness(t, Config{Namespaces: namespaces, TrustedProxies: []string{"127.0.0.1"}, Admins: []string{"admin"}})
+	h.fake.SetUser("alice", duotest.Allow)
+
+	if status, _ := h.do("POST", "/v1/grant/deploy?keys=deploy-*&user=alice&duration=2h", "", ""); status != http.StatusForbidden {
+		t.Errorf("grant for longer than the namespace allows returned %d", status)
+	}
+
+	status, body := h.do("POST", "/v1/grant/deploy?keys=deploy-*&user=alice", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("grant returned %d: %s", status, body)
+	}
+	var g grant
+	if err := json.Unmarshal([]byte(body), &g); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := h.check("deploy-1", "alice"); status != http.StatusOK {
+		t.Errorf("check of a granted key returned %d", status)
+	}
+	if status := h.check("deploy-1", "bob"); status != http.StatusInternalServerError {
+		t.Errorf("check of a key granted to someone else returned %d", status)
+	}
+
+	if status, _ := h.do("DELETE", "/v1/admin/grants/"+g.ID, "alice", ""); status != http.StatusForbidden {
+		t.Errorf("revoke by a client who isn't an admin returned %d", status)
+	}
+	if status, body := h.do("DELETE", "/v1/admin/grants/"+g.ID, "admin", ""); status != http.StatusOK {
+		t.Fatalf("revoke returned %d: %s", status, body)
+	}
+	if status := h.check("deploy-1", "alice"); status != http.StatusInternalServerError {
+		t.Errorf("check of a revoked grant returned %d", status)
+	}
+}
+
+func TestAdminNeedsTrustedProxy(t *testing.T) {
+	h := newHarness(t, Config{Admins: []string{"admin"}})
+	if status, _ := h.do("GET", "/v1/admin/grants", "admin", ""); status != http.StatusForbidden {
+		t.Errorf("admin header from an untrusted proxy returned %d", status)
+	}
+
+	h = newHarness(t, Config{Admins: []string{"admin"}, TrustedProxies: []string{"127.0.0.1"}})
+	if status, _ := h.do("GET", "/v1/admin/grants", "admin", ""); status != http.StatusOK {
+		t.Errorf("admin header from a trusted proxy returned %d", status)
+	}
+}
+
+func TestEnrollAuthorization(t *testing.T) {
+	h := newHarness(t, Config{Admins: []string{"admin"}, TrustedProxies: []string{"127.0.0.1"}})
+
+	for client, want := range map[string]int{
+		"":      http.StatusForbidden,
+		"bob":   http.StatusForbidden,
+		"alice": http.StatusOK,
+		"admin": http.StatusOK,
+	} {
+		if status, body := h.do("POST", "/v1/enroll/alice", client, ""); status != want {
+			t.Errorf("enrolling alice as %q returned %d, want %d: %s", client, status, want, body)
+		}
+	}
+}
+
+func TestEnrollLink(t *testing.T) {
+	h := newHarness(t, Config{Admins: []string{"admin"}, TrustedProxies: []string{"127.0.0.1"}})
+
+	for client, link := range map[string]bool{
+		"":      false,
+		"bob":   false,
+		"carol": true,
+		"admin": true,
+	} {
+		_, body := h.do("POST", "/v1/push/key?user=carol", client, "")
+		if got := strings.Contains(body, "https://fake-duo.example.com/portal"); got != link {
+			t.Errorf("pushing carol as %q gave the enroll link: %v, want %v: %s", client, got, link, body)
+		}
+		if !link && !strings.Contains(body, "POST /v1/enroll/carol") {
+			t.Errorf("pushing carol as %q didn't say how to enroll: %s", client, body)
+		}
+	}
+}
+
+func TestDevices(t *testing.T) {
+	h := newHarness(t, Config{})
+	h.fake.SetUser("alice", duotest.Allow)
+	h.fake.SetUser("bob", duotest.LockedOut)
+
+	for user, want := range map[string]string{"alice": preauthAuth, "bob": preauthDeny, "carol": preauthEnroll} {
+		status, body := h.do("GET", "/v1/users/"+user+"/devices", "", "")
+		if status != http.StatusOK {
+			t.Fatalf("listing %s's devices returned %d: %s", user, status, body)
+		}
+		var payload devicesPayload
+		if err := json.Unmarshal([]byte(body), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Status != want {
+			t.Errorf("%s's devices have status %q, want %q", user, payload.Status, want)
+		}
+		if got := len(payload.Devices) > 0; got != (want == preauthAuth) {
+			t.Errorf("%s has devices: %v, want %v", user, got, want == preauthAuth)
+		}
+	}
+}
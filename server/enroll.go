@@ -0,0 +1,214 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/mfa"
+)
+
+// enrollments remembers each user's latest enrollment, so its status can be checked by user alone
+type enrollments struct {
+	mu     sync.Mutex
+	byUser map[string]*mfa.Enrollment
+}
+
+func (e *enrollments) get(user string) *mfa.Enrollment {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.byUser[user]
+}
+
+func (e *enrollments) set(user string, en *mfa.Enrollment) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.byUser == nil {
+		e.byUser = make(map[string]*mfa.Enrollment)
+	}
+	e.byUser[user] = en
+}
+
+func (e *enrollments) remove(user string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.byUser, user)
+}
+
+// enrollmentStatusPayload is where a user's enrollment has got to
+type enrollmentStatusPayload struct {
+	User string `json:"user"`
+	// One of waiting, success or invalid
+	Status string `json:"status"`
+}
+
+// enroller returns the provider named by the request's provider param, or the default, if users can enroll with it
+func (s *Server) enroller(c echo.Context) (mfa.Enroller, string, error) {
+	name := c.QueryParam("provider")
+	if name == "" {
+		name = s.defaultProvider
+	}
+	provider, ok := s.providers[name]
+	if !ok {
+		return nil, name, errors.Errorf("Unknown MFA provider %s\n", name)
+	}
+	enroller, ok := provider.(mfa.Enroller)
+	if !ok {
+		return nil, name, errors.Errorf("MFA provider %s doesn't support enrollment\n", name)
+	}
+	return enroller, name, nil
+}
+
+// actsFor returns whether req's client is user, as mapped by identity.default, or is an admin.  Only they can
+// enroll devices for user, since whoever activates one can approve user's prompts.
+func (s *Server) actsFor(req *requestInfo, user string) bool {
+	if s.isAdmin(req) {
+		return true
+	}
+	if req.client == "" {
+		return false
+	}
+	client, err := s.canonicalUser(s.defaultIdentity, req.client)
+	return err == nil && client == user
+}
+
+// refuseEnrollment refuses, and audits, a client enrolling someone else or checking on their enrollment
+func (s *Server) refuseEnrollment(c echo.Context, req *requestInfo, user string, logger *log.Entry) error {
+	msg := fmt.Sprintf("Client '%s' can't enroll %s, only they or an admin can", req.client, user)
+	if req.client == "" {
+		msg = fmt.Sprintf("Unidentified clients can't enroll %s, only they or an admin can", user)
+	}
+	logger.Warn(msg)
+	s.audit(req, audit.Event{
+		Type:    audit.EventEnrollment,
+		User:    user,
+		Result:  "refused",
+		Message: msg,
+	})
+	return c.String(http.StatusForbidden, msg+"\n")
+}
+
+// enrollHandler starts enrolling a device for a user, returning the barcode for them to activate it with
+func (s *Server) enrollHandler(c echo.Context) error {
+	req := s.newRequestInfo(c)
+	user, err := s.canonicalUser(s.defaultIdentity, c.Param("user"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	logger := getLogger(req.id, "", user)
+	if !s.actsFor(req, user) {
+		return s.refuseEnrollment(c, req, user, logger)
+	}
+
+	enroller, name, err := s.enroller(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	en, err := enroller.Enroll(c.Request().Context(), user)
+	if err != nil {
+		msg := errors.Wrap(err, "Error enrolling user")
+		logger.Error(msg)
+		s.audit(req, audit.Event{
+			Type:     audit.EventEnrollment,
+			User:     user,
+			Result:   "error",
+			Message:  msg.Error(),
+			Metadata: map[string]string{"provider": name},
+		})
+		if mfa.IsUnavailable(err) {
+			return c.String(http.StatusServiceUnavailable, "MFA provider is unavailable, try again later\n")
+		}
+		return c.String(http.StatusBadRequest, s.redact.String(msg.Error()))
+	}
+
+	logger.Infof("Started enrollment, expiring at %s", en.Expires)
+	s.audit(req, audit.Event{
+		Type:   audit.EventEnrollment,
+		User:   user,
+		Result: "started",
+		Metadata: map[string]string{
+			"provider": name,
+			"userID":   en.UserID,
+		},
+	})
+	s.enrollments.set(user, en)
+
+	return c.JSON(http.StatusOK, en)
+}
+
+// enrollStatusHandler says whether a user has activated their enrollment.  The enrollment is the user's
+// latest, unless one's given by the userID and activationCode params.
+func (s *Server) enrollStatusHandler(c echo.Context) error {
+	req := s.newRequestInfo(c)
+	user, err := s.canonicalUser(s.defaultIdentity, c.Param("user"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	logger := getLogger(req.id, "", user)
+	if !s.actsFor(req, user) {
+		return s.refuseEnrollment(c, req, user, logger)
+	}
+
+	enroller, name, err := s.enroller(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	userID, code := c.QueryParam("userID"), c.QueryParam("activationCode")
+	latest := userID == "" || code == ""
+	if latest {
+		en := s.enrollments.get(user)
+		if en == nil {
+			return c.String(http.StatusNotFound, fmt.Sprintf("No enrollment found for %s, pass userID and activationCode\n", user))
+		}
+		userID, code = en.UserID, en.ActivationCode
+	}
+
+	status, err := enroller.EnrollStatus(c.Request().Context(), userID, code)
+	if err != nil {
+		msg := errors.Wrap(err, "Error checking enrollment")
+		logger.Error(msg)
+		if mfa.IsUnavailable(err) {
+			return c.String(http.StatusServiceUnavailable, "MFA provider is unavailable, try again later\n")
+		}
+		return c.String(http.StatusBadRequest, s.redact.String(msg.Error()))
+	}
+
+	logger.Infof("Enrollment is %s", status)
+	if status != mfa.EnrollmentWaiting {
+		s.audit(req, audit.Event{
+			Type:   audit.EventEnrollment,
+			User:   user,
+			Result: status,
+			Metadata: map[string]string{
+				"provider": name,
+				"userID":   userID,
+			},
+		})
+		if latest {
+			s.enrollments.remove(user)
+		}
+	}
+
+	return c.JSON(http.StatusOK, enrollmentStatusPayload{User: user, Status: status})
+}
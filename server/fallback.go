@@ -0,0 +1,163 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/state"
+)
+
+// The factors a prompt can fall back to
+var fallbackFactors = []string{"push", "phone", "sms"}
+
+// fallbackOutcome is what came of trying to fall back to the next factor
+type fallbackOutcome int
+
+const (
+	// fallbackNone means there was nothing left to fall back to, so the transaction ends as it was going to
+	fallbackNone fallbackOutcome = iota
+	// fallbackTracking means a new transaction was sent, and is being tracked in place of the old one
+	fallbackTracking
+	// fallbackAwaitingPasscode means passcodes were sent, and the prompt is awaiting one instead of being tracked
+	fallbackAwaitingPasscode
+	// fallbackSettled means preauth for the fallback let the user through or refused them, without a prompt
+	fallbackSettled
+)
+
+// fallbackFor returns the factors in ns's fallback chain after factor
+func fallbackFor(ns Namespace, factor string) []string {
+	for i, f := range ns.Fallback {
+		if f == factor {
+			return ns.Fallback[i+1:]
+		}
+	}
+	return nil
+}
+
+// unanswered returns whether res means the user never answered, as opposed to refusing the prompt
+func unanswered(res authStatusResult) bool {
+	return res.status == state.StatusTimedOut || (res.status == state.StatusDenied && res.duoStatus == "timeout")
+}
+
+// fallBack sends the prompt with the next factor in d's fallback chain that the user has a device for.  If preauth
+// says the user is to be let through or refused, it's settled that way instead, with the result returned.
+func (d *duoTXNTracker) fallBack() (fallbackOutcome, authStatusResult) {
+	for len(d.fallback) > 0 {
+		next := d.fallback[0]
+		d.fallback = d.fallback[1:]
+
+		logger := d.logger.WithField("fallbackFactor", next)
+		logger.Warnf("No answer to %s, falling back to %s", d.factor, next)
+		d.server.audit(d.req, audit.Event{
+			Type:     audit.EventDuoResponse,
+			Key:      d.key,
+			User:     d.user,
+			TxID:     d.txnid,
+			Factor:   d.factor,
+			Result:   "timeout",
+			Metadata: map[string]string{"fallbackTo": next},
+		})
+
+		pc := promptConfig{
+			user:   d.user,
+			factor: next,
+			device: "auto",
+			async:  true,
+
+			ipAddr:          d.req.ipAddr(),
+			displayUsername: d.displayUsername,
+			pushInfo:        d.pushInfo,
+		}
+		if err := d.server.namespaceFor(d.key).renderPush(&pc, d.key, d.req.client); err != nil {
+			logger.Warn(errors.Wrapf(err, "Can't fall back to %s", next))
+			continue
+		}
+		pr, err := d.server.preauth(d.ctx, d.provider, &pc)
+		if de, ok := errors.Cause(err).(*denyError); ok && !de.factorUnavailable {
+			// Refused outright, like the user would be by preauth for a new prompt
+			logger.Warn(errors.Wrapf(err, "Not falling back to %s", next))
+			d.fellBackTo(next)
+			return fallbackSettled, authStatusResult{status: state.StatusDenied, duoStatus: de.status}
+		}
+		if err != nil {
+			logger.Warn(errors.Wrapf(err, "Can't fall back to %s", next))
+			continue
+		}
+		if pr.Result == preauthAllow {
+			logger.Infof("Prompt bypassed: %s", pr.Message)
+			d.fellBackTo(next)
+			return fallbackSettled, authStatusResult{status: state.StatusAllowed, duoStatus: preauthAllow}
+		}
+
+		res, err := d.server.prompt(d.ctx, d.provider, &pc, d.key)
+		if err != nil {
+			logger.Error(errors.Wrapf(err, "Error falling back to %s", next))
+			continue
+		}
+
+		switch {
+		case res.Status == mfa.StatusPasscodeSent:
+			d.server.forgetPending(d)
+			d.fellBackTo(next)
+			if err := d.server.getPrompt(d.key).AwaitPasscode(d.ts, d.provider.Name(), d.server.passcodeTTL, d.server.passcodeAttempts); err != nil {
+				logger.Error(err)
+				d.server.transition(d.req, d.key, d.user, next, state.StatusDenied, err.Error())
+			} else {
+				logger.Info(res.Message)
+				d.server.transition(d.req, d.key, d.user, next, state.StatusAwaitingPasscode, "")
+			}
+			d.span.End()
+			return fallbackAwaitingPasscode, authStatusResult{}
+		case res.TxID != "":
+			d.server.forgetPending(d)
+			d.fellBackTo(next)
+			d.txnid = res.TxID
+			d.sent = time.Now()
+			d.deadline = d.sent.Add(asyncTimeout)
+			d.nextPoll = d.sent
+			d.logger = d.logger.WithFields(log.Fields{"TXNID": d.txnid})
+			d.server.persistPending(d)
+			d.server.audit(d.req, audit.Event{
+				Type:     audit.EventDuoResponse,
+				Key:      d.key,
+				User:     d.user,
+				TxID:     d.txnid,
+				Factor:   d.factor,
+				Result:   "async",
+				Metadata: map[string]string{"firstFactor": d.firstFactor},
+			})
+			return fallbackTracking, authStatusResult{}
+		default:
+			logger.Errorf("Falling back to %s didn't start a transaction, got %s", next, res.Status)
+		}
+	}
+
+	return fallbackNone, authStatusResult{}
+}
+
+// fellBackTo records that d's prompt is now with factor, rather than the one it was sent with
+func (d *duoTXNTracker) fellBackTo(factor string) {
+	if d.firstFactor == "" {
+		d.firstFactor = d.factor
+	}
+	d.factor = factor
+	d.span.SetAttribute("duo.fallback_factor", factor)
+}
@@ -0,0 +1,366 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/twinj/uuid"
+
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/state"
+)
+
+// grantFactors are the factors a grant can be prompted with, grants are only prompted synchronously
+var grantFactors = []string{"push", "phone", "passcode"}
+
+// A grant is one approval covering every key in a namespace matching a pattern, until it expires
+type grant struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace"`
+	Keys      string    `json:"keys"`
+	User      string    `json:"user"`
+	Factor    string    `json:"factor"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// Who asked for the grant
+	Client string `json:"client,omitempty"`
+}
+
+// covers says whether g approves key, in namespace ns, for user, at now.  user is optional.
+func (g *grant) covers(key string, ns string, user string, now time.Time) bool {
+	if g.Namespace != ns || now.After(g.Expires) || (user != "" && user != g.User) {
+		return false
+	}
+	ok, _ := path.Match(g.Keys, key)
+	return ok
+}
+
+// grants are the grants that haven't been revoked, which are only kept until duo-bot restarts
+type grants struct {
+	mu   sync.Mutex
+	byID map[string]*grant
+}
+
+func (gs *grants) add(g *grant) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.byID == nil {
+		gs.byID = make(map[string]*grant)
+	}
+	gs.byID[g.ID] = g
+}
+
+func (gs *grants) revoke(id string) (*grant, bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	g, ok := gs.byID[id]
+	delete(gs.byID, id)
+	return g, ok
+}
+
+// covering returns the grant expiring last that covers key for user, if any does
+func (gs *grants) covering(key string, ns string, user string) *grant {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.prune()
+
+	var best *grant
+	now := time.Now()
+	for _, g := range gs.byID {
+		if g.covers(key, ns, user, now) && (best == nil || g.Expires.After(best.Expires)) {
+			best = g
+		}
+	}
+	return best
+}
+
+// active returns the grants that haven't expired, oldest first
+func (gs *grants) active() []grant {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.prune()
+
+	list := make([]grant, 0, len(gs.byID))
+	for _, g := range gs.byID {
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// prune forgets expired grants.  gs.mu must be held.
+func (gs *grants) prune() {
+	now := time.Now()
+	for id, g := range gs.byID {
+		if now.After(g.Expires) {
+			delete(gs.byID, id)
+		}
+	}
+}
+
+// grantHandler prompts a user once for a grant covering the keys in a namespace matching the keys pattern, for
+// the duration asked for, up to the namespace's max_grant
+func (s *Server) grantHandler(c echo.Context) error {
+	pattern := c.QueryParam("keys")
+	req := s.newRequestInfo(c)
+	logger := getLogger(req.id, pattern, c.QueryParam("user"))
+
+	if s.isDraining() {
+		logger.Warn("Shutting down, rejecting new grant")
+		return c.String(http.StatusServiceUnavailable, "Shutting down, not accepting new prompts\n")
+	}
+
+	ns, ok := s.namespaceNamed(c.Param("namespace"))
+	if !ok {
+		return c.String(http.StatusNotFound, fmt.Sprintf("No namespace %s\n", c.Param("namespace")))
+	}
+	logger = logger.WithField("namespace", ns.Name)
+	if ns.maxGrant == 0 {
+		return c.String(http.StatusForbidden, fmt.Sprintf("Namespace %s doesn't allow grants\n", ns.Name))
+	}
+
+	if pattern == "" {
+		return c.String(http.StatusBadRequest, "You must specify the keys to grant approval of\n")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid keys pattern '%s'\n", pattern))
+	}
+
+	duration := ns.maxGrant
+	if d := c.QueryParam("duration"); d != "" {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid duration '%s'\n", d))
+		}
+	}
+	if duration > ns.maxGrant {
+		return c.String(http.StatusForbidden, fmt.Sprintf("Grants in namespace %s can't be for longer than %v\n", ns.Name, ns.maxGrant))
+	}
+
+	factor := c.QueryParam("factor")
+	if factor == "" {
+		factor = "push"
+	}
+	if !contains(grantFactors, factor) {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Grants can only be prompted with %v\n", grantFactors))
+	}
+
+	user, err := s.canonicalUser(ns.Identity, c.QueryParam("user"))
+	if err != nil {
+		logger.Error(err)
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	logger = logger.WithField("user", user)
+
+	providerName, err := s.chooseProvider(ns, user, c.QueryParam("provider"))
+	req.breakGlass = s.isBreakGlass(providerName)
+	logger = logger.WithField("provider", providerName)
+	g := grant{
+		ID:        uuid.NewV4().String(),
+		Namespace: ns.Name,
+		Keys:      pattern,
+		User:      user,
+		Factor:    factor,
+		Client:    req.client,
+	}
+	auditMeta := func() map[string]string {
+		return map[string]string{
+			"grant":     g.ID,
+			"namespace": ns.Name,
+			"provider":  providerName,
+			"duration":  duration.String(),
+		}
+	}
+	if err != nil {
+		logger.Error(err)
+		s.audit(req, audit.Event{
+			Type:     audit.EventPromptCreated,
+			Key:      pattern,
+			User:     user,
+			Factor:   factor,
+			Result:   "forbidden",
+			Message:  err.Error(),
+			Metadata: auditMeta(),
+		})
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	provider := s.providers[providerName]
+
+	meta := new(MetadataPayload)
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(meta); err != nil {
+			logger.Warn(errors.Wrap(err, "error binding extra metadata object, skipping"))
+		}
+	}
+
+	s.audit(req, audit.Event{
+		Type:     audit.EventPromptCreated,
+		Key:      pattern,
+		User:     user,
+		Factor:   factor,
+		Metadata: auditMeta(),
+	})
+
+	// Every failure from here on is the end of the grant
+	grantFailed := func(status int, err error) error {
+		msg := errors.Wrap(err, "Grant not given")
+		logger.Error(msg)
+		s.audit(req, audit.Event{
+			Type:     audit.EventDuoResponse,
+			Key:      pattern,
+			User:     user,
+			Factor:   factor,
+			Result:   "error",
+			Message:  msg.Error(),
+			Metadata: map[string]string{"grant": g.ID, "duoStatus": duoStatus(err)},
+		})
+		if mfa.IsUnavailable(err) {
+			return c.String(http.StatusServiceUnavailable, "MFA provider is unavailable, try again later\n")
+		}
+		return c.String(status, s.redact.String(msg.Error()))
+	}
+
+	pc, err := newPromptConfig(user, factor, c.QueryParam("device"), meta.Passcode, false)
+	if err != nil {
+		return grantFailed(http.StatusBadRequest, err)
+	}
+	pc.ipAddr = req.ipAddr()
+	pc.actsForUser = s.actsFor(req, user)
+	pc.displayUsername = c.QueryParam("display_username")
+	// The push says what's being granted, in place of a key
+	pc.pushInfo = map[string]string{"Grant for": duration.String()}
+	if err := ns.renderPush(pc, pattern, req.client); err != nil {
+		return grantFailed(http.StatusBadRequest, err)
+	}
+
+	pr, err := s.preauth(c.Request().Context(), provider, pc)
+	if err != nil {
+		return grantFailed(http.StatusBadRequest, err)
+	}
+	msg := pr.Message
+	if pr.Result != preauthAllow {
+		logger.Infof("Calling MFA prompt for grant with %s on device %s", pc.factor, pc.device)
+		res, err := s.prompt(c.Request().Context(), provider, pc, pattern)
+		if err != nil {
+			return grantFailed(http.StatusBadRequest, err)
+		}
+		if res.Status != mfa.StatusAllowed {
+			return grantFailed(http.StatusInternalServerError, errors.Errorf("unexpected %s result from %s", res.Status, providerName))
+		}
+		msg = res.Message
+	}
+
+	g.Factor = pc.factor
+	g.Created = time.Now()
+	g.Expires = g.Created.Add(duration)
+	s.grants.add(&g)
+
+	logger.WithFields(log.Fields{
+		"grant":   g.ID,
+		"expires": g.Expires,
+	}).Infof("Grant given: %s", msg)
+	s.audit(req, audit.Event{
+		Type:     audit.EventDuoResponse,
+		Key:      pattern,
+		User:     user,
+		Factor:   g.Factor,
+		Result:   "allow",
+		Message:  msg,
+		Metadata: auditMeta(),
+	})
+	return c.JSON(http.StatusOK, g)
+}
+
+// grantedCheck is the valid result of checking key, for user if given, if a grant covers it
+func (s *Server) grantedCheck(key string, user string) (checkResult, bool) {
+	ns := s.namespaceFor(key)
+	if ns.maxGrant == 0 {
+		return checkResult{}, false
+	}
+	g := s.grants.covering(key, ns.Name, user)
+	if g == nil {
+		return checkResult{}, false
+	}
+
+	return checkResult{
+		valid: true,
+		msg: fmt.Sprintf("Grant %s of %s to user %s is valid until %s\n",
+			g.ID, g.Keys, g.User, g.Expires.UTC().Format(time.RFC822)),
+		approval: state.Approval{
+			User:    g.User,
+			Factor:  g.Factor,
+			At:      g.Created,
+			Expires: g.Expires,
+		},
+		grant: g.ID,
+	}, true
+}
+
+// isAdmin says whether req is from a client allowed to use the admin endpoints
+func (s *Server) isAdmin(req *requestInfo) bool {
+	return req.client != "" && contains(s.admins, req.client)
+}
+
+// listGrantsHandler lists the grants that haven't expired or been revoked, for admins
+func (s *Server) listGrantsHandler(c echo.Context) error {
+	req := s.newRequestInfo(c)
+	if !s.isAdmin(req) {
+		return c.String(http.StatusForbidden, "Only admins can list grants\n")
+	}
+	return c.JSON(http.StatusOK, s.grants.active())
+}
+
+// revokeGrantHandler revokes a grant, for admins
+func (s *Server) revokeGrantHandler(c echo.Context) error {
+	id := c.Param("id")
+	req := s.newRequestInfo(c)
+	logger := getLogger(req.id, "", "").WithField("grant", id)
+
+	event := audit.Event{
+		Type:     audit.EventAdminAction,
+		Metadata: map[string]string{"action": "revoke_grant", "grant": id},
+	}
+	if !s.isAdmin(req) {
+		logger.Warnf("Client '%s' isn't an admin, refusing to revoke grant", req.client)
+		event.Result = "forbidden"
+		s.audit(req, event)
+		return c.String(http.StatusForbidden, "Only admins can revoke grants\n")
+	}
+
+	g, ok := s.grants.revoke(id)
+	if !ok {
+		event.Result = "not_found"
+		s.audit(req, event)
+		return c.String(http.StatusNotFound, fmt.Sprintf("No grant %s\n", id))
+	}
+
+	logger.Infof("Revoked grant of %s in namespace %s to %s", g.Keys, g.Namespace, g.User)
+	event.Key = g.Keys
+	event.User = g.User
+	event.Result = "revoked"
+	s.audit(req, event)
+	return c.String(http.StatusOK, fmt.Sprintf("Revoked grant %s\n", id))
+}
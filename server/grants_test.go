@@ -0,0 +1,78 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGrantCovers(t *testing.T) {
+	now := time.Now()
+	g := grant{Namespace: "deploy", Keys: "prod-*", User: "alice", Expires: now.Add(time.Hour)}
+
+	for name, tc := range map[string]struct {
+		key, ns, user string
+		at            time.Time
+		want          bool
+	}{
+		"match":           {"prod-1", "deploy", "alice", now, true},
+		"any user":        {"prod-1", "deploy", "", now, true},
+		"other user":      {"prod-1", "deploy", "bob", now, false},
+		"other namespace": {"prod-1", "build", "alice", now, false},
+		"other key":       {"staging-1", "deploy", "alice", now, false},
+		"across a slash":  {"prod-1/x", "deploy", "alice", now, false},
+		"expired":         {"prod-1", "deploy", "alice", now.Add(2 * time.Hour), false},
+	} {
+		if got := g.covers(tc.key, tc.ns, tc.user, tc.at); got != tc.want {
+			t.Errorf("%s: covers = %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestGrantsCoveringAndRevoke(t *testing.T) {
+	now := time.Now()
+	var gs grants
+	gs.add(&grant{ID: "short", Namespace: "deploy", Keys: "*", User: "alice", Created: now, Expires: now.Add(time.Minute)})
+	gs.add(&grant{ID: "long", Namespace: "deploy", Keys: "prod-*", User: "alice", Created: now.Add(time.Second), Expires: now.Add(time.Hour)})
+	gs.add(&grant{ID: "expired", Namespace: "deploy", Keys: "*", User: "alice", Created: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)})
+
+	if g := gs.covering("prod-1", "deploy", "alice"); g == nil || g.ID != "long" {
+		t.Fatalf("expected the grant expiring last to cover prod-1, got %+v", g)
+	}
+	if g := gs.covering("staging-1", "deploy", "alice"); g == nil || g.ID != "short" {
+		t.Fatalf("expected the wildcard grant to cover staging-1, got %+v", g)
+	}
+
+	active := gs.active()
+	if len(active) != 2 || active[0].ID != "short" || active[1].ID != "long" {
+		t.Errorf("expected the unexpired grants oldest first, got %+v", active)
+	}
+
+	if _, ok := gs.revoke("long"); !ok {
+		t.Fatal("couldn't revoke the grant")
+	}
+	if _, ok := gs.revoke("long"); ok {
+		t.Error("revoked the grant twice")
+	}
+	if g := gs.covering("prod-1", "deploy", "alice"); g == nil || g.ID != "short" {
+		t.Errorf("expected the remaining grant to cover prod-1 once revoked, got %+v", g)
+	}
+
+	gs.revoke("short")
+	if g := gs.covering("prod-1", "deploy", "alice"); g != nil {
+		t.Errorf("expected nothing to cover prod-1 once every grant is revoked, got %+v", g)
+	}
+}
@@ -17,13 +17,30 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/labstack/echo"
 	"github.com/pkg/errors"
-	"github.com/twinj/uuid"
+
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/state"
+	"github.com/palantir/duo-bot/tracing"
 )
 
+// checkPayload is the result of a check, for clients that accept JSON
+type checkPayload struct {
+	Valid   bool   `json:"valid"`
+	Message string `json:"message"`
+	// What the approved prompt showed the user
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// What the check presented differently from the context the approval is bound to
+	Mismatches []string `json:"mismatches,omitempty"`
+	// A signed JWT of the approval, if one was asked for, see the receipt package
+	Receipt string `json:"receipt,omitempty"`
+}
+
 type healthCheckPayload struct {
 	Healthy string `json:"healthy"`
 	Version string `json:"version"`
@@ -32,18 +49,23 @@ type healthCheckPayload struct {
 // MetadataPayload object is what clients send to include
 // as extra metadata in the DUO push request
 type MetadataPayload struct {
-	DuoPushInfo string `json:"duoPushInfo"`
+	// Key/value pairs to show the user, which checks return
+	Metadata map[string]string `json:"metadata"`
+	// Deprecated, Metadata URL-encoded
+	DuoPushInfo string `json:"duoPushInfo" form:"duoPushInfo"`
+	// Passcode is sent in the body so it never shows up in URLs or access logs
+	Passcode string `json:"passcode" form:"passcode"`
 }
 
-func getLogger(key string, user string) *log.Entry {
-	requestID := uuid.NewV4()
-
+func getLogger(requestID string, key string, user string) *log.Entry {
 	newLogger := log.New()
 	newLogger.Formatter = log.StandardLogger().Formatter
 	newLogger.Level = log.StandardLogger().Level
+	// Carry over the redaction hook, among others
+	newLogger.Hooks = log.StandardLogger().Hooks
 	logger := newLogger.WithFields(log.Fields{
 		"key":       key,
-		"requestID": requestID.String(),
+		"requestID": requestID,
 		"user":      user,
 	})
 
@@ -66,13 +88,17 @@ func (s *Server) phoneHandler(c echo.Context) error {
 	return s.promptHandler(c, "phone")
 }
 
+// autoHandler prompts with whichever factor the user's devices best support
+func (s *Server) autoHandler(c echo.Context) error {
+	return s.promptHandler(c, autoFactor)
+}
+
 func (s *Server) promptHandler(c echo.Context, factor string) error {
 	// Check if there's a pending challenge for this key
 	// Issue challenge for this key to this user
 	key := c.Param("key")
 	user := c.QueryParam("user")
 	device := c.QueryParam("device")
-	passcode := c.QueryParam("passcode")
 	asyncParam := c.QueryParam("async")
 
 	async := false
@@ -80,14 +106,56 @@ func (s *Server) promptHandler(c echo.Context, factor string) error {
 		async = true
 	}
 
-	logger := getLogger(key, user)
+	req := s.newRequestInfo(c)
+	logger := getLogger(req.id, key, user)
 
-	logger.Info("Clobbering previous state for key, if any")
-	// Any new request clobbers any previous one and sets status to pending
-	// Return a timestamp so we know we're only updating state if they match
-	ts := s.resetStateForKey(key, user)
+	// Anything approved before the drain still checks out, but there's no one left to track a new prompt
+	if s.isDraining() {
+		logger.Warn("Shutting down, rejecting new prompt")
+		return c.String(http.StatusServiceUnavailable, "Shutting down, not accepting new prompts\n")
+	}
+
+	ns := s.namespaceFor(key)
+	callerUser := user
+	user, err := s.canonicalUser(ns.Identity, callerUser)
+	if err != nil {
+		logger.Error(err)
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	if user != callerUser {
+		logger = logger.WithFields(log.Fields{
+			"user":       user,
+			"callerUser": callerUser,
+		})
+	}
 
-	curPrompt := s.state[key]
+	providerName, err := s.chooseProvider(ns, user, c.QueryParam("provider"))
+	req.breakGlass = s.isBreakGlass(providerName)
+	logger = logger.WithFields(log.Fields{
+		"namespace": ns.Name,
+		"provider":  providerName,
+	})
+	if err != nil {
+		logger.Error(err)
+		s.audit(req, audit.Event{
+			Type:    audit.EventPromptCreated,
+			Key:     key,
+			User:    user,
+			Factor:  factor,
+			Result:  "forbidden",
+			Message: err.Error(),
+			Metadata: map[string]string{
+				"namespace": ns.Name,
+				"provider":  providerName,
+			},
+		})
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	provider := s.providers[providerName]
+	if req.breakGlass {
+		logger = logger.WithField("breakGlass", true)
+		logger.Warnf("BREAK-GLASS prompt with provider %s", providerName)
+	}
 
 	meta := new(MetadataPayload)
 	if c.Request().ContentLength != 0 {
@@ -98,65 +166,265 @@ func (s *Server) promptHandler(c echo.Context, factor string) error {
 		}
 	}
 
+	passcode := meta.Passcode
+	if passcode == "" && c.QueryParam("passcode") != "" {
+		logger.Warn("Passcode passed as a query param, send it in the request body instead")
+		passcode = c.QueryParam("passcode")
+	}
+
+	// A passcode for a prompt that sent passcodes completes it, rather than starting a new one.  That holds even once
+	// the prompt's no longer awaiting one, otherwise a new prompt would take the passcodes sent with no limit on
+	// attempts and no expiry.
+	if factor == "passcode" {
+		if p := s.getPrompt(key); p != nil {
+			if _, ok := p.SentPasscodes(); ok {
+				return s.completePasscode(c, req, logger, key, user, provider, p, passcode)
+			}
+		}
+	}
+
+	logger.Info("Clobbering previous state for key, if any")
+	// Any new request clobbers any previous one and sets status to pending
+	// Return a timestamp so we know we're only updating state if they match
+	ts, curPrompt := s.resetStateForKey(key, user)
+
+	s.audit(req, audit.Event{
+		Type:   audit.EventPromptCreated,
+		Key:    key,
+		User:   user,
+		Factor: factor,
+		Metadata: map[string]string{
+			"device":      device,
+			"async":       asyncParam,
+			"metadata":    encodeMetadata(meta.Metadata),
+			"duoPushInfo": meta.DuoPushInfo,
+			"namespace":   ns.Name,
+			"provider":    providerName,
+			"callerUser":  callerUser,
+		},
+	})
+
 	pc, err := newPromptConfig(user, factor, device, passcode, async)
+	if err == nil {
+		pc.pushInfo, err = pushInfo(meta, logger)
+	}
+	if err == nil {
+		err = ns.renderPush(pc, key, req.client)
+	}
+	var binding *state.Binding
+	if err == nil {
+		binding, err = ns.binding(pc.pushInfo, req.client)
+	}
 	if err != nil {
 		curPrompt.Deny()
+		s.transition(req, key, user, factor, state.StatusDenied, err.Error())
 		logger.Error(err.Error())
 		return c.String(http.StatusBadRequest, err.Error())
 	}
+	pc.ipAddr = req.ipAddr()
+	pc.actsForUser = s.actsFor(req, user)
+	pc.displayUsername = c.QueryParam("display_username")
+	curPrompt.SetMetadata(pc.pushInfo)
+	curPrompt.SetBinding(binding)
 
-	logger.Info("Calling DUO prompt")
-	res, err := s.prompt(pc, key, meta)
-	if err != nil {
+	// Every failure from here on denies the prompt
+	promptFailed := func(err error) error {
 		msg := errors.Wrap(err, "Error from DUO")
 		logger.Error(msg)
+		s.audit(req, audit.Event{
+			Type:     audit.EventDuoResponse,
+			Key:      key,
+			User:     user,
+			Factor:   pc.factor,
+			Result:   "error",
+			Message:  msg.Error(),
+			Metadata: map[string]string{"duoStatus": duoStatus(err)},
+		})
 		curPrompt.Deny()
-		return c.String(http.StatusBadRequest, msg.Error())
+		s.transition(req, key, user, pc.factor, state.StatusDenied, msg.Error())
+		if mfa.IsUnavailable(err) {
+			return c.String(http.StatusServiceUnavailable, "MFA provider is unavailable, try again later\n")
+		}
+		return c.String(http.StatusBadRequest, s.redact.String(msg.Error()))
 	}
 
-	if pc.async {
-		// We want to decorate res before returning it to the user, but we need
-		// the raw TXN ID returned as well
-		txnID := res
-		res = fmt.Sprintf("Async prompt sent, txn ID: %s\n", res)
-		// Create a goroutine to poll for change of this state
-		logger.Info(res)
-		dt := s.newDuoTXNTracker(key, txnID, ts, logger)
-		go dt.asyncHelper()
-	} else {
-		res = fmt.Sprintf("Prompt successful: %s", res)
+	pr, err := s.preauth(c.Request().Context(), provider, pc)
+	if err != nil {
+		return promptFailed(err)
+	}
+	logger.Infof("Preauth result %s", pr.Result)
+	s.audit(req, audit.Event{
+		Type:    audit.EventDuoResponse,
+		Key:     key,
+		User:    user,
+		Factor:  pc.factor,
+		Result:  "preauth",
+		Message: pr.Message,
+		Metadata: map[string]string{
+			"preauth": pr.Result,
+			"device":  pc.device,
+			"devices": describeDevices(pr.Devices),
+		},
+	})
+
+	// The provider lets this user through without prompting them
+	if pr.Result == preauthAllow {
+		res := fmt.Sprintf("Prompt bypassed: %s\n", pr.Message)
 		logger.Info(res)
-		err = curPrompt.TryAllow(ts)
+		err = curPrompt.TryAllow(ts, pc.factor)
 		if err != nil {
+			s.transition(req, key, user, pc.factor, state.StatusDenied, err.Error())
 			logger.Error(err)
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
+		s.transition(req, key, user, pc.factor, state.StatusAllowed, "")
+		return c.String(http.StatusOK, res)
 	}
 
-	return c.String(http.StatusOK, res)
+	logger.Infof("Calling MFA prompt with %s on device %s", pc.factor, pc.device)
+	res, err := s.prompt(c.Request().Context(), provider, pc, key)
+	if err != nil {
+		return promptFailed(err)
+	}
+
+	var out string
+	switch {
+	case res.Status == mfa.StatusPasscodeSent:
+		// The user answers with one of the passcodes at /v1/passcode, see completePasscode
+		s.audit(req, audit.Event{
+			Type:    audit.EventDuoResponse,
+			Key:     key,
+			User:    user,
+			Factor:  pc.factor,
+			Result:  "passcode_sent",
+			Message: res.Message,
+		})
+		err = curPrompt.AwaitPasscode(ts, providerName, s.passcodeTTL, s.passcodeAttempts)
+		if err != nil {
+			s.transition(req, key, user, pc.factor, state.StatusDenied, err.Error())
+			logger.Error(err)
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		s.transition(req, key, user, pc.factor, state.StatusAwaitingPasscode, "")
+		out = fmt.Sprintf("%s Send one to /v1/passcode/%s within %v\n", res.Message, key, s.passcodeTTL)
+		logger.Info(out)
+	case res.TxID != "":
+		s.audit(req, audit.Event{
+			Type:   audit.EventDuoResponse,
+			Key:    key,
+			User:   user,
+			TxID:   res.TxID,
+			Factor: pc.factor,
+			Result: "async",
+		})
+		out = fmt.Sprintf("Async prompt sent, txn ID: %s\n", res.TxID)
+		// Create a goroutine to poll for change of this state
+		logger.Info(out)
+		dt := s.newDuoTXNTracker(key, user, pc.factor, provider, res.TxID, ts, req, tracing.FromContext(c.Request().Context()).SpanContext(), logger)
+		dt.fallback = fallbackFor(ns, pc.factor)
+		dt.displayUsername = pc.displayUsername
+		dt.pushInfo = pc.pushInfo
+		dt.binding = binding
+		s.startTracker(dt)
+	default:
+		s.audit(req, audit.Event{
+			Type:    audit.EventDuoResponse,
+			Key:     key,
+			User:    user,
+			Factor:  pc.factor,
+			Result:  "allow",
+			Message: res.Message,
+		})
+		out = fmt.Sprintf("Prompt successful: %s", res.Message)
+		logger.Info(out)
+		err = curPrompt.TryAllow(ts, pc.factor)
+		if err != nil {
+			s.transition(req, key, user, pc.factor, state.StatusDenied, err.Error())
+			logger.Error(err)
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		s.transition(req, key, user, pc.factor, state.StatusAllowed, "")
+	}
+
+	return c.String(http.StatusOK, out)
 }
 
 func (s *Server) checkHandler(c echo.Context) error {
 	key := c.Param("key")
 	user := c.QueryParam("user")
 
-	logger := getLogger(key, user)
+	req := s.newRequestInfo(c)
+	logger := getLogger(req.id, key, user)
 
-	valid, msg := s.isValid(key, user)
+	// Prompts are recorded against the canonical user, so that's who has to be checked
+	callerUser := user
+	user, err := s.canonicalUser(s.namespaceFor(key).Identity, callerUser)
+	if err != nil {
+		logger.Error(err)
+		return c.String(http.StatusBadRequest, err.Error()+"\n")
+	}
+	if user != callerUser {
+		logger = logger.WithFields(log.Fields{
+			"user":       user,
+			"callerUser": callerUser,
+		})
+	}
 
-	logger.Info(msg)
+	// Receipts only come as JSON
+	wantReceipt := c.QueryParam("receipt") == "1"
+	if wantReceipt && s.receipts == nil {
+		return c.String(http.StatusBadRequest, "Receipts aren't enabled\n")
+	}
 
-	if valid {
-		return c.String(http.StatusOK, msg)
+	check := s.isValid(key, user, presentedContext(c), req.client)
+
+	logger.Info(check.msg)
+
+	var signed string
+	if check.valid && wantReceipt {
+		signed, err = s.receiptFor(key, check)
+		if err != nil {
+			logger.Error(err)
+			return c.String(http.StatusInternalServerError, err.Error()+"\n")
+		}
 	}
 
-	return c.String(http.StatusInternalServerError, msg)
-}
+	result := "invalid"
+	if check.valid {
+		result = "valid"
+	}
+	s.metrics.checks.Inc(result)
+	meta := make(map[string]string)
+	if len(check.mismatches) > 0 {
+		meta["mismatches"] = strings.Join(check.mismatches, ",")
+	}
+	if signed != "" {
+		meta["receipt"] = "issued"
+	}
+	if check.grant != "" {
+		meta["grant"] = check.grant
+	}
+	s.audit(req, audit.Event{
+		Type:     audit.EventCheck,
+		Key:      key,
+		User:     user,
+		Result:   result,
+		Message:  check.msg,
+		Metadata: meta,
+	})
 
-func (s *Server) healthHandler(c echo.Context) error {
-	p := healthCheckPayload{
-		Healthy: "yes",
-		Version: s.version,
+	status := http.StatusInternalServerError
+	if check.valid {
+		status = http.StatusOK
+	}
+	if wantReceipt || strings.Contains(c.Request().Header.Get("Accept"), echo.MIMEApplicationJSON) {
+		return c.JSON(status, checkPayload{
+			Valid:      check.valid,
+			Message:    strings.TrimSpace(check.msg),
+			Metadata:   check.metadata,
+			Mismatches: check.mismatches,
+			Receipt:    signed,
+		})
 	}
-	return c.JSON(http.StatusOK, p)
+	return c.String(status, check.msg)
 }
@@ -0,0 +1,299 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/duoclient"
+)
+
+const (
+	defaultProbeInterval     = 30 * time.Second
+	defaultMaxClockSkew      = 30 * time.Second
+	defaultMaxTrackerBacklog = 1000
+)
+
+// componentStatus is the health of one thing duo-bot depends on
+type componentStatus struct {
+	Healthy bool `json:"healthy"`
+	// Still working, but not as configured, e.g. on an old identity mapping because the new one didn't load
+	Degraded bool                   `json:"degraded,omitempty"`
+	Message  string                 `json:"message,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+type readinessPayload struct {
+	Ready bool `json:"ready"`
+	// Whether any component is degraded, which doesn't stop us being ready
+	Degraded   bool                       `json:"degraded,omitempty"`
+	Version    string                     `json:"version"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// healthChecks is every component that decides whether we're ready, by name
+type healthChecks struct {
+	mu     sync.Mutex
+	checks map[string]func() componentStatus
+}
+
+func (h *healthChecks) register(name string, check func() componentStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checks == nil {
+		h.checks = make(map[string]func() componentStatus)
+	}
+	h.checks[name] = check
+}
+
+func (h *healthChecks) run() readinessPayload {
+	h.mu.Lock()
+	var names []string
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	h.mu.Unlock()
+	sort.Strings(names)
+
+	p := readinessPayload{
+		Ready:      true,
+		Components: make(map[string]componentStatus),
+	}
+	for _, name := range names {
+		h.mu.Lock()
+		check := h.checks[name]
+		h.mu.Unlock()
+
+		status := check()
+		p.Components[name] = status
+		if !status.Healthy {
+			p.Ready = false
+		}
+		if status.Degraded {
+			p.Degraded = true
+		}
+	}
+
+	return p
+}
+
+// duoProbe is the result of the last time we checked we can talk to DUO
+type duoProbe struct {
+	mu        sync.Mutex
+	lastProbe time.Time
+	lastOK    time.Time
+	err       error
+	// How far ahead of DUO our clock is
+	clockSkew time.Duration
+}
+
+// probeDuo pings DUO and checks our credentials, recording how it went for readiness
+func (s *Server) probeDuo(ctx context.Context) error {
+	skew, err := s.duoCheck(ctx)
+
+	s.duoProbe.mu.Lock()
+	defer s.duoProbe.mu.Unlock()
+
+	now := time.Now()
+	s.duoProbe.lastProbe = now
+	s.duoProbe.err = err
+	if err == nil {
+		s.duoProbe.lastOK = now
+		s.duoProbe.clockSkew = skew
+	}
+
+	return err
+}
+
+// runDuoProbes keeps probing DUO every probeInterval until ctx is done
+func (s *Server) runDuoProbes(ctx context.Context) {
+	ticker := time.NewTicker(s.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.probeDuo(ctx); err != nil {
+				log.Warn(errors.Wrap(err, "DUO readiness probe failed"))
+			}
+		}
+	}
+}
+
+func (s *Server) duoHealth() componentStatus {
+	s.duoProbe.mu.Lock()
+	defer s.duoProbe.mu.Unlock()
+
+	breaker := s.duoAPI.Breaker()
+
+	st := componentStatus{
+		Healthy: true,
+		Details: map[string]interface{}{
+			"clockSkewSeconds": s.duoProbe.clockSkew.Seconds(),
+			"circuitBreaker":   breaker.String(),
+		},
+	}
+	if !s.duoProbe.lastProbe.IsZero() {
+		st.Details["lastProbe"] = s.duoProbe.lastProbe.UTC().Format(time.RFC3339)
+	}
+	if !s.duoProbe.lastOK.IsZero() {
+		st.Details["lastOK"] = s.duoProbe.lastOK.UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case breaker == duoclient.BreakerOpen:
+		st.Healthy = false
+		st.Message = "Circuit breaker is open, DUO has been failing"
+	case s.duoProbe.lastProbe.IsZero():
+		st.Healthy = false
+		st.Message = "DUO hasn't been probed yet"
+	case s.duoProbe.err != nil:
+		st.Healthy = false
+		st.Message = s.redact.String(s.duoProbe.err.Error())
+	case abs(s.duoProbe.clockSkew) > s.maxClockSkew:
+		st.Healthy = false
+		st.Message = fmt.Sprintf("Clock is %v off from DUO's, more than the allowed %v", s.duoProbe.clockSkew, s.maxClockSkew)
+	}
+
+	return st
+}
+
+func (s *Server) stateHealth() componentStatus {
+	counts := s.stateCounts()
+
+	details := make(map[string]interface{})
+	for status, n := range counts {
+		details[status] = n
+	}
+	details["backend"] = "memory"
+
+	// In memory state can't be unavailable
+	return componentStatus{
+		Healthy: true,
+		Details: details,
+	}
+}
+
+func (s *Server) trackerHealth() componentStatus {
+	inFlight := int(s.metrics.asyncTrackers.Value())
+
+	st := componentStatus{
+		Healthy: true,
+		Details: map[string]interface{}{
+			"inFlight":    inFlight,
+			"max":         s.maxTrackerBacklog,
+			"queued":      s.poller.len(),
+			"pollWorkers": s.poller.workers,
+		},
+	}
+	if inFlight > s.maxTrackerBacklog {
+		st.Healthy = false
+		st.Message = fmt.Sprintf("%d async trackers in flight, more than the allowed %d", inFlight, s.maxTrackerBacklog)
+	}
+
+	return st
+}
+
+// configHealth reports the config file, and how each identity mapping file was last reloaded.  A mapping that
+// failed to reload leaves us degraded rather than not ready, the one loaded before it is still in use.
+func (s *Server) configHealth() componentStatus {
+	st := componentStatus{
+		Healthy: true,
+		Details: map[string]interface{}{
+			"file":     s.configFile,
+			"loadedAt": s.configLoaded.UTC().Format(time.RFC3339),
+		},
+	}
+
+	var names []string
+	for name := range s.identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	identities := make(map[string]interface{})
+	var failed []string
+	for _, name := range names {
+		status := s.identities[name].Status()
+		if status.File == "" {
+			continue
+		}
+		details := map[string]interface{}{
+			"file":     status.File,
+			"loadedAt": status.LoadedAt.UTC().Format(time.RFC3339),
+		}
+		if status.Err != nil {
+			details["error"] = status.Err.Error()
+			failed = append(failed, name)
+		}
+		identities[name] = details
+	}
+	if len(identities) > 0 {
+		st.Details["identities"] = identities
+	}
+	if len(failed) > 0 {
+		st.Degraded = true
+		st.Message = fmt.Sprintf("Identity mappings %s failed to reload, using the ones loaded before", strings.Join(failed, ", "))
+	}
+
+	return st
+}
+
+func (s *Server) registerHealthChecks() {
+	s.health.register("duo", s.duoHealth)
+	s.health.register("state", s.stateHealth)
+	s.health.register("trackers", s.trackerHealth)
+	s.health.register("config", s.configHealth)
+	s.health.register("shutdown", s.shutdownHealth)
+}
+
+// liveHandler only says whether we're up at all
+func (s *Server) liveHandler(c echo.Context) error {
+	p := healthCheckPayload{
+		Healthy: "yes",
+		Version: s.version,
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// readyHandler says whether we can actually serve prompts and checks
+func (s *Server) readyHandler(c echo.Context) error {
+	p := s.health.run()
+	p.Version = s.version
+
+	if !p.Ready {
+		return c.JSON(http.StatusServiceUnavailable, p)
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/palantir/duo-bot/identity"
+)
+
+func TestConfigHealthReportsFailedReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yml")
+	if err := ioutil.WriteFile(path, []byte("octocat: alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := identity.New(identity.Config{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness(t, Config{Identities: map[string]*identity.Mapper{"github": m}})
+
+	if st := h.s.configHealth(); !st.Healthy || st.Degraded {
+		t.Fatalf("expected config to be healthy, got %+v", st)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("octocat: [alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.Reload()
+
+	st := h.s.configHealth()
+	if !st.Healthy || !st.Degraded || st.Message == "" {
+		t.Errorf("expected config to be degraded by the failed reload, got %+v", st)
+	}
+	details := st.Details["identities"].(map[string]interface{})["github"].(map[string]interface{})
+	if details["error"] == nil {
+		t.Errorf("expected the reload error in the details, got %+v", details)
+	}
+	if p := h.s.health.run(); !p.Degraded {
+		t.Errorf("expected readiness to report being degraded, got %+v", p)
+	}
+}
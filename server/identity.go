@@ -0,0 +1,32 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+// canonicalUser returns the DUO username for the username a caller gave, through the named identity mapping.
+// With no mapping, or no username, it's returned as is.
+func (s *Server) canonicalUser(mapping string, user string) (string, error) {
+	if mapping == "" || user == "" {
+		return user, nil
+	}
+	canonical, err := s.identities[mapping].Map(user)
+	if err != nil {
+		return "", errors.Wrapf(err, "error mapping user with %s", mapping)
+	}
+	return canonical, nil
+}
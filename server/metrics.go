@@ -0,0 +1,75 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/palantir/duo-bot/metrics"
+	"github.com/palantir/duo-bot/state"
+)
+
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	prompts        *metrics.CounterVec
+	checks         *metrics.CounterVec
+	duoLatency     *metrics.HistogramVec
+	duoErrors      *metrics.CounterVec
+	duoRateLimited *metrics.CounterVec
+	asyncTrackers  *metrics.Gauge
+}
+
+func (s *Server) newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+
+	m := serverMetrics{
+		registry: r,
+		prompts: r.NewCounterVec("duobot_prompts_total",
+			"MFA prompts by factor and final outcome", "factor", "outcome"),
+		checks: r.NewCounterVec("duobot_checks_total",
+			"Check requests by result", "result"),
+		duoLatency: r.NewHistogramVec("duobot_duo_request_duration_seconds",
+			"Latency of calls to the DUO Auth API by endpoint", metrics.DefaultBuckets, "endpoint"),
+		duoErrors: r.NewCounterVec("duobot_duo_errors_total",
+			"Calls to the DUO Auth API that failed or returned a non-OK stat, by endpoint", "endpoint"),
+		duoRateLimited: r.NewCounterVec("duobot_duo_rate_limited_total",
+			"Calls to the DUO Auth API rejected by DUO's rate limiting, by endpoint", "endpoint"),
+		asyncTrackers: r.NewGauge("duobot_async_trackers_in_flight",
+			"Async DUO transactions currently being tracked"),
+	}
+
+	r.NewGaugeFunc("duobot_state_prompts", "Prompts held in state by status", "status", s.stateCounts)
+
+	return &m
+}
+
+// stateCounts returns how many prompts are in state for each status
+func (s *Server) stateCounts() map[string]float64 {
+	counts := map[string]float64{
+		state.StatusAllowed.String():          0,
+		state.StatusDenied.String():           0,
+		state.StatusPending.String():          0,
+		state.StatusTimedOut.String():         0,
+		state.StatusAwaitingPasscode.String(): 0,
+	}
+
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+
+	for _, p := range s.state {
+		counts[p.Status().String()]++
+	}
+
+	return counts
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultNamespace is the namespace of keys no configured namespace matches
+const defaultNamespace = "default"
+
+// A Namespace is a set of keys, sharing settings like which MFA provider prompts for them
+type Namespace struct {
+	Name string `mapstructure:"name"`
+	// Glob patterns (as in path.Match) for the keys in the namespace
+	Keys []string `mapstructure:"keys"`
+	// The name of the MFA provider to prompt with, defaults to the server's default provider
+	Provider string `mapstructure:"provider"`
+	// Factors async prompts fall back through in order when the user doesn't answer, e.g. push, phone, sms
+	Fallback []string `mapstructure:"fallback"`
+	// The name of the identity mapping callers' usernames go through, defaults to the server's default mapping
+	Identity string `mapstructure:"identity"`
+	// How pushes for keys in the namespace look, they show the key if unset
+	Push PushTemplate `mapstructure:"push"`
+	// Metadata fields approvals are bound to, checks have to present the same values to pass
+	Bind []string `mapstructure:"bind"`
+	// Whether approvals are bound to the calling client too, so only it can check them
+	BindClient bool `mapstructure:"bind_client"`
+	// The longest users can grant themselves approval of keys in the namespace for, e.g. 8h.  No grants if unset.
+	MaxGrant string `mapstructure:"max_grant"`
+
+	push     *compiledPush
+	maxGrant time.Duration
+}
+
+// validateNamespaces checks every namespace is usable, filling in defaults
+func (s *Server) validateNamespaces(namespaces []Namespace) error {
+	seen := make(map[string]bool)
+	for i := range namespaces {
+		ns := &namespaces[i]
+
+		if ns.Name == "" {
+			return errors.Errorf("namespace %d has no name", i)
+		}
+		if ns.Name == defaultNamespace || seen[ns.Name] {
+			return errors.Errorf("namespace name '%s' is already taken", ns.Name)
+		}
+		seen[ns.Name] = true
+
+		if len(ns.Keys) == 0 {
+			return errors.Errorf("namespace %s matches no keys", ns.Name)
+		}
+		for _, pattern := range ns.Keys {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "namespace %s has an invalid key pattern '%s'", ns.Name, pattern)
+			}
+		}
+
+		if ns.Provider == "" {
+			ns.Provider = s.defaultProvider
+		}
+		if _, ok := s.providers[ns.Provider]; !ok {
+			return errors.Errorf("namespace %s uses unknown MFA provider '%s'", ns.Name, ns.Provider)
+		}
+
+		push, err := ns.Push.compile()
+		if err != nil {
+			return errors.Wrapf(err, "namespace %s has an invalid push template", ns.Name)
+		}
+		ns.push = push
+
+		for i, field := range ns.Bind {
+			if strings.TrimSpace(field) == "" {
+				return errors.Errorf("namespace %s binds approvals to a field with no name", ns.Name)
+			}
+			if contains(ns.Bind[:i], field) {
+				return errors.Errorf("namespace %s binds approvals to %s twice", ns.Name, field)
+			}
+		}
+
+		if ns.MaxGrant != "" {
+			maxGrant, err := time.ParseDuration(ns.MaxGrant)
+			if err != nil || maxGrant <= 0 {
+				return errors.Errorf("namespace %s has an invalid max_grant '%s'", ns.Name, ns.MaxGrant)
+			}
+			// A grant covers many operations, so it can't be bound to the context of one
+			if len(ns.Bind) > 0 || ns.BindClient {
+				return errors.Errorf("namespace %s binds approvals to their context, so it can't allow grants", ns.Name)
+			}
+			ns.maxGrant = maxGrant
+		}
+
+		if ns.Identity == "" {
+			ns.Identity = s.defaultIdentity
+		}
+		if _, ok := s.identities[ns.Identity]; ns.Identity != "" && !ok {
+			return errors.Errorf("namespace %s uses unknown identity mapping '%s'", ns.Name, ns.Identity)
+		}
+
+		for i, factor := range ns.Fallback {
+			if !contains(fallbackFactors, factor) {
+				return errors.Errorf("namespace %s can't fall back to factor '%s', only to %v", ns.Name, factor, fallbackFactors)
+			}
+			if contains(ns.Fallback[:i], factor) {
+				return errors.Errorf("namespace %s falls back to %s twice", ns.Name, factor)
+			}
+		}
+	}
+
+	s.namespaces = namespaces
+	return nil
+}
+
+// namespaceNamed returns the configured namespace called name, if there is one
+func (s *Server) namespaceNamed(name string) (Namespace, bool) {
+	for _, ns := range s.namespaces {
+		if ns.Name == name {
+			return ns, true
+		}
+	}
+	return Namespace{}, false
+}
+
+// namespaceFor returns the first namespace with a pattern matching key, or the default namespace
+func (s *Server) namespaceFor(key string) Namespace {
+	for _, ns := range s.namespaces {
+		for _, pattern := range ns.Keys {
+			if ok, _ := path.Match(pattern, key); ok {
+				return ns
+			}
+		}
+	}
+	return Namespace{Name: defaultNamespace, Provider: s.defaultProvider, Identity: s.defaultIdentity}
+}
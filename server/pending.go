@@ -0,0 +1,129 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/mfa/duo"
+	"github.com/palantir/duo-bot/state"
+	"github.com/palantir/duo-bot/tracing"
+)
+
+// persistPending records d's transaction as pending, if we're persisting them
+func (s *Server) persistPending(d *duoTXNTracker) {
+	if s.pending == nil {
+		return
+	}
+	if err := s.pending.Add(d.pending()); err != nil {
+		d.logger.Error(errors.Wrap(err, "Error persisting pending transaction, it won't survive a restart"))
+	}
+}
+
+// forgetPending records that d's transaction is no longer pending
+func (s *Server) forgetPending(d *duoTXNTracker) {
+	if s.pending == nil {
+		return
+	}
+	s.forgetTxn(d.txnid, d.logger)
+}
+
+// forgetTxn records that the transaction txid is no longer pending
+func (s *Server) forgetTxn(txid string, logger *log.Entry) {
+	if err := s.pending.Remove(txid); err != nil {
+		logger.Error(errors.Wrap(err, "Error removing finished transaction from pending"))
+	}
+}
+
+// resumePending picks back up the async transactions a previous run left pending.  Those DUO could still
+// answer get their prompt restored and a new tracker, the rest time out.
+func (s *Server) resumePending() {
+	if s.pending == nil {
+		return
+	}
+
+	txns := s.pending.All()
+	if len(txns) == 0 {
+		return
+	}
+	log.Infof("Resuming %d pending async prompts from %s", len(txns), s.pending.Path())
+
+	// A newer prompt clobbers an older one for the same key, so only the newest can still be resumed
+	newest := make(map[string]time.Time)
+	for _, txn := range txns {
+		if txn.Created.After(newest[txn.Key]) {
+			newest[txn.Key] = txn.Created
+		}
+	}
+
+	for _, txn := range txns {
+		req := &requestInfo{
+			id:       txn.RequestID,
+			client:   txn.Client,
+			sourceIP: txn.SourceIP,
+		}
+		logger := getLogger(req.id, txn.Key, txn.User).WithFields(log.Fields{
+			"TXNID": txn.TxID,
+		})
+
+		if !txn.Created.Equal(newest[txn.Key]) {
+			logger.Info("Pending transaction was superseded by a newer prompt, dropping it")
+			s.forgetTxn(txn.TxID, logger)
+			continue
+		}
+
+		p := state.NewPrompt(txn.Created, txn.User)
+		p.SetMetadata(txn.Metadata)
+		p.SetBinding(txn.Binding)
+		s.restorePrompt(txn.Key, p)
+
+		name := txn.Provider
+		if name == "" {
+			name = duo.Name
+		}
+		provider, ok := s.providers[name]
+		if !ok {
+			logger.Warnf("Pending transaction is with MFA provider '%s', which is no longer configured, timing it out", name)
+			p.TimeOut()
+			s.transition(req, txn.Key, txn.User, txn.Factor, state.StatusTimedOut, "duo-bot restarted without the transaction's MFA provider")
+			s.forgetTxn(txn.TxID, logger)
+			continue
+		}
+		d := s.newDuoTXNTracker(txn.Key, txn.User, txn.Factor, provider, txn.TxID, txn.Created, req, tracing.SpanContext{}, logger)
+		d.fallback = txn.Fallback
+		d.displayUsername = txn.DisplayUsername
+		d.pushInfo = txn.Metadata
+		d.binding = txn.Binding
+		if !txn.Sent.IsZero() {
+			d.sent = txn.Sent
+			d.deadline = txn.Sent.Add(asyncTimeout)
+		}
+
+		age := time.Since(d.sent)
+		if age < duoTxnWindow {
+			logger.Infof("Resuming tracking of async prompt sent %v ago", age)
+			s.startTracker(d)
+			continue
+		}
+
+		logger.Warnf("Async prompt sent %v ago is past DUO's window to answer, timing it out", age)
+		p.TimeOut()
+		s.transition(req, txn.Key, txn.User, txn.Factor, state.StatusTimedOut, "duo-bot restarted after DUO stopped waiting for an answer")
+		s.forgetPending(d)
+	}
+}
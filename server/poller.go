@@ -0,0 +1,255 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/palantir/duo-bot/state"
+)
+
+const (
+	defaultPollWorkers = 10
+
+	// Back-off from DUO rate limiting us starts here, doubling each time we're still rate limited
+	minRateLimitBackoff = time.Second
+	maxRateLimitBackoff = time.Minute
+)
+
+// poller asks DUO's auth_status about every outstanding async transaction, from a fixed number of workers.
+// Transactions DUO is still waiting on go back on the end of the queue, as do ones DUO doesn't answer about within
+// maxPollWait, so workers are never all stuck in long-polls.
+type poller struct {
+	server  *Server
+	workers int
+
+	mu    sync.Mutex
+	queue []*duoTXNTracker
+	// Holds a token whenever there might be something in the queue for an idle worker
+	wake chan struct{}
+
+	// While DUO is rate limiting us, no worker calls it before pausedUntil
+	backoff     time.Duration
+	pausedUntil time.Time
+
+	wg sync.WaitGroup
+}
+
+func newPoller(s *Server, workers int) *poller {
+	if workers <= 0 {
+		workers = defaultPollWorkers
+	}
+	return &poller{
+		server:  s,
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// start runs the workers until ctx is cancelled, at which point whatever's left is abandoned
+func (p *poller) start(ctx context.Context) {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work(ctx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		p.wg.Wait()
+
+		// No worker is left to re-queue anything, so the queue is final
+		p.mu.Lock()
+		queue := p.queue
+		p.queue = nil
+		p.mu.Unlock()
+
+		for _, d := range queue {
+			d.abandon()
+			p.server.endTracker(d, false)
+		}
+	}()
+}
+
+// enqueue adds d to the back of the queue
+func (p *poller) enqueue(d *duoTXNTracker) {
+	p.mu.Lock()
+	p.queue = append(p.queue, d)
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *poller) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// len returns how many transactions are waiting for a worker
+func (p *poller) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// next blocks until there's something in the queue, returning false if ctx is cancelled first
+func (p *poller) next(ctx context.Context) (*duoTXNTracker, bool) {
+	for {
+		p.mu.Lock()
+		if len(p.queue) > 0 {
+			d := p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			more := len(p.queue) > 0
+			p.mu.Unlock()
+
+			// There's only ever one token, so pass it on for the next idle worker
+			if more {
+				p.signal()
+			}
+			return d, true
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-p.wake:
+		}
+	}
+}
+
+// sleepUntil blocks until t, returning false if ctx is cancelled first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (p *poller) work(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		d, ok := p.next(ctx)
+		if !ok {
+			return
+		}
+
+		// The queue is in the order transactions were last polled, so the head is always the next one due
+		if !sleepUntil(ctx, d.nextPoll) || !sleepUntil(ctx, p.resumeAt()) {
+			d.abandon()
+			p.server.endTracker(d, false)
+			continue
+		}
+
+		res, rateLimited := d.poll()
+		if rateLimited {
+			p.rateLimited()
+		} else {
+			p.recovered()
+		}
+
+		if res.status != state.StatusPending {
+			p.settle(d, res)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			d.abandon()
+			p.server.endTracker(d, false)
+			continue
+		}
+
+		// Only once we've asked DUO, so a transaction that waited a while in the queue isn't lost if the user answered
+		if time.Now().After(d.deadline) {
+			p.settle(d, authStatusResult{status: state.StatusTimedOut})
+			continue
+		}
+
+		d.nextPoll = time.Now().Add(pollInterval)
+		p.enqueue(d)
+	}
+}
+
+// settle deals with d's transaction ending with res.  If the user never answered, the prompt falls back to
+// the next factor in d's chain, otherwise it's finished.
+func (p *poller) settle(d *duoTXNTracker, res authStatusResult) {
+	if unanswered(res) {
+		switch outcome, settled := d.fallBack(); outcome {
+		case fallbackTracking:
+			p.enqueue(d)
+			return
+		case fallbackAwaitingPasscode:
+			p.server.endTracker(d, true)
+			return
+		case fallbackSettled:
+			res = settled
+		}
+	}
+
+	d.finish(res)
+	p.server.endTracker(d, true)
+}
+
+func (p *poller) resumeAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pausedUntil
+}
+
+// rateLimited pauses every worker, for twice as long as last time if we're still being rate limited
+func (p *poller) rateLimited() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.backoff == 0 {
+		p.backoff = minRateLimitBackoff
+	} else if p.backoff < maxRateLimitBackoff {
+		p.backoff *= 2
+		if p.backoff > maxRateLimitBackoff {
+			p.backoff = maxRateLimitBackoff
+		}
+	}
+
+	// Jitter, so we don't all come back at once
+	pause := p.backoff/2 + time.Duration(rand.Int63n(int64(p.backoff/2)+1))
+	if until := time.Now().Add(pause); until.After(p.pausedUntil) {
+		p.pausedUntil = until
+		log.Warnf("Rate limited by DUO, pausing auth_status polling for %v", pause)
+	}
+}
+
+// recovered resets the back-off once DUO answers us again
+func (p *poller) recovered() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.backoff = 0
+}
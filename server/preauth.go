@@ -0,0 +1,109 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/mfa"
+)
+
+// autoFactor is the factor asking for whichever the user's devices best support
+const autoFactor = "auto"
+
+// defaultFactorPreference is the order factors are tried in for autoFactor prompts
+var defaultFactorPreference = []string{"push", "phone", "sms"}
+
+// Preflight results, as DUO's preauth names them
+const (
+	preauthAuth   = "auth"
+	preauthAllow  = "allow"
+	preauthDeny   = "deny"
+	preauthEnroll = "enroll"
+)
+
+// preauth asks provider whether and how pc's user can be prompted.  For users who need prompting, pc's
+// factor and device are filled in from the devices they have.  Users who are to be let through
+// without a prompt get a result of preauthAllow, everyone else who can't be prompted gets an error.
+func (s *Server) preauth(ctx context.Context, provider mfa.Provider, pc *promptConfig) (*mfa.PreflightResult, error) {
+	pr, err := provider.Preflight(ctx, mfa.PreflightRequest{User: pc.user, IPAddr: pc.ipAddr})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error running preauth")
+	}
+
+	switch pr.Result {
+	case preauthAllow:
+		return pr, nil
+	case preauthDeny:
+		return nil, &denyError{status: preauthDeny, msg: pr.Message}
+	case preauthEnroll:
+		// Whoever activates a device can approve the user's prompts, so only the user or an admin gets the link
+		msg := fmt.Sprintf("%s is not enrolled", pc.user)
+		switch _, canEnroll := provider.(mfa.Enroller); {
+		case pr.EnrollURL != "" && pc.actsForUser:
+			msg = fmt.Sprintf("%s, enroll at %s", msg, pr.EnrollURL)
+		case canEnroll:
+			msg = fmt.Sprintf("%s, they can enroll with POST /v1/enroll/%s", msg, url.PathEscape(pc.user))
+		case pr.EnrollURL != "":
+			msg = fmt.Sprintf("%s, they can find where to enroll with GET /v1/users/%s/devices", msg, url.PathEscape(pc.user))
+		}
+		return nil, &denyError{status: preauthEnroll, msg: msg}
+	case preauthAuth:
+	default:
+		return nil, errors.Errorf("Unknown preauth result '%s'\n", pr.Result)
+	}
+
+	// A passcode is checked the same whatever device it came from
+	if pc.factor == "passcode" {
+		return pr, nil
+	}
+
+	factors := []string{pc.factor}
+	if pc.factor == autoFactor {
+		factors = s.factorPreference
+	}
+	for _, factor := range factors {
+		for _, d := range pr.Devices {
+			if !contains(d.Capabilities, factor) {
+				continue
+			}
+			if pc.device != "auto" && pc.device != d.ID {
+				continue
+			}
+			pc.factor = factor
+			pc.device = d.ID
+			return pr, nil
+		}
+	}
+
+	if pc.device != "auto" {
+		return nil, &denyError{status: preauthDeny, msg: fmt.Sprintf("device %s of %s can't do any of %s", pc.device, pc.user, strings.Join(factors, ", ")), factorUnavailable: true}
+	}
+	return nil, &denyError{status: preauthDeny, msg: fmt.Sprintf("%s has no device that can do any of %s", pc.user, strings.Join(factors, ", ")), factorUnavailable: true}
+}
+
+// describeDevices summarizes devices for the audit log, without phone numbers
+func describeDevices(devices []mfa.Device) string {
+	descs := make([]string, 0, len(devices))
+	for _, d := range devices {
+		descs = append(descs, fmt.Sprintf("%s(%s:%s)", d.ID, d.Type, strings.Join(d.Capabilities, "/")))
+	}
+	return strings.Join(descs, ",")
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/mfa/duo"
+)
+
+// keyPushField is the push info field showing the user the key they're approving, for namespaces with no push template
+const keyPushField = "Key"
+
+// A PushTemplate renders what pushes show the user with text/template, from pushData
+type PushTemplate struct {
+	// What kind of request the push is, e.g. "Merge to {{.Metadata.branch}}", defaults to the provider's own
+	Type string `mapstructure:"type"`
+	// Fields shown first in the push, in order, in place of the key.  Fields rendering empty are left out.
+	Info []PushFieldTemplate `mapstructure:"info"`
+}
+
+// A PushFieldTemplate renders one push info field
+type PushFieldTemplate struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+// pushData is what push templates are rendered from
+type pushData struct {
+	Key       string
+	User      string
+	Namespace string
+	// The calling client's identity, from the client header
+	Client string
+	// The prompt's metadata, missing fields render empty
+	Metadata map[string]string
+}
+
+// compiledPush is a PushTemplate ready to render
+type compiledPush struct {
+	typ       *template.Template
+	names     []string
+	templates []*template.Template
+}
+
+// compile parses t's templates, a nil compiledPush shows the key
+func (t PushTemplate) compile() (*compiledPush, error) {
+	if t.Type == "" && len(t.Info) == 0 {
+		return nil, nil
+	}
+
+	var cp compiledPush
+	var err error
+	if t.Type != "" {
+		cp.typ, err = parsePushTemplate("type", t.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range t.Info {
+		if strings.TrimSpace(f.Name) == "" {
+			return nil, errors.New("push info fields must have a name")
+		}
+		if contains(cp.names, f.Name) {
+			return nil, errors.Errorf("push info field '%s' is templated twice", f.Name)
+		}
+		tmpl, err := parsePushTemplate(f.Name, f.Value)
+		if err != nil {
+			return nil, err
+		}
+		cp.names = append(cp.names, f.Name)
+		cp.templates = append(cp.templates, tmpl)
+	}
+	return &cp, nil
+}
+
+func parsePushTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	return tmpl, errors.Wrapf(err, "invalid push template for %s", name)
+}
+
+func renderPushTemplate(tmpl *template.Template, data *pushData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", errors.Wrapf(err, "error rendering push template for %s", tmpl.Name())
+	}
+	out := strings.TrimSpace(b.String())
+	if strings.IndexFunc(out, unicode.IsControl) >= 0 {
+		return "", errors.Errorf("push template for %s rendered control characters", tmpl.Name())
+	}
+	return out, nil
+}
+
+// renderPush fills in what pc's push shows the user in ns: the templated type and fields, or the key, followed by
+// the metadata in name order.  client is the calling client's identity.
+func (ns Namespace) renderPush(pc *promptConfig, key string, client string) error {
+	var fields []mfa.PushField
+	if ns.push == nil {
+		fields = append(fields, mfa.PushField{Name: keyPushField, Value: key})
+	} else {
+		data := pushData{
+			Key:       key,
+			User:      pc.user,
+			Namespace: ns.Name,
+			Client:    client,
+			Metadata:  pc.pushInfo,
+		}
+		if data.Metadata == nil {
+			data.Metadata = map[string]string{}
+		}
+
+		if ns.push.typ != nil {
+			typ, err := renderPushTemplate(ns.push.typ, &data)
+			if err != nil {
+				return err
+			}
+			pc.pushType = typ
+		}
+		for _, tmpl := range ns.push.templates {
+			value, err := renderPushTemplate(tmpl, &data)
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				fields = append(fields, mfa.PushField{Name: tmpl.Name(), Value: value})
+			}
+		}
+	}
+
+	// The templated fields are ours, metadata can't pass itself off as one of them
+	reserved := []string{keyPushField}
+	if ns.push != nil {
+		reserved = ns.push.names
+	}
+	names := make([]string, 0, len(pc.pushInfo))
+	for k := range pc.pushInfo {
+		for _, r := range reserved {
+			if strings.EqualFold(k, r) {
+				return errors.Errorf("metadata field '%s' is reserved", k)
+			}
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fields = append(fields, mfa.PushField{Name: k, Value: pc.pushInfo[k]})
+	}
+
+	if size := len(duo.EncodePushInfo(fields)); size > duo.MaxPushInfoSize {
+		return errors.Errorf("push info is %d bytes URL-encoded, the most DUO can show is %d", size, duo.MaxPushInfoSize)
+	}
+	pc.pushFields = fields
+	return nil
+}
+
+// pushInfo returns the metadata to show the user with a prompt, from either the metadata object or the
+// deprecated duoPushInfo string, having checked it can be shown as it is
+func pushInfo(meta *MetadataPayload, logger *log.Entry) (map[string]string, error) {
+	info := make(map[string]string, len(meta.Metadata))
+	for k, v := range meta.Metadata {
+		info[k] = v
+	}
+
+	if meta.DuoPushInfo != "" {
+		logger.Warn("duoPushInfo is deprecated, send metadata as a JSON object instead")
+		values, err := url.ParseQuery(meta.DuoPushInfo)
+		if err != nil {
+			return nil, errors.Wrap(err, "duoPushInfo isn't URL-encoded key/value pairs")
+		}
+		for k, vs := range values {
+			if _, ok := info[k]; ok || len(vs) > 1 {
+				return nil, errors.Errorf("metadata field '%s' is given more than once", k)
+			}
+			info[k] = vs[0]
+		}
+	}
+
+	for k, v := range info {
+		if strings.TrimSpace(k) == "" {
+			return nil, errors.New("metadata fields must have a name")
+		}
+		if strings.IndexFunc(k+v, unicode.IsControl) >= 0 {
+			return nil, errors.Errorf("metadata field '%s' contains control characters", k)
+		}
+	}
+	return info, nil
+}
+
+// encodeMetadata URL-encodes metadata, e.g. for the audit log, where field=value pairs are redacted by name
+func encodeMetadata(metadata map[string]string) string {
+	values := make(url.Values, len(metadata))
+	for k, v := range metadata {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
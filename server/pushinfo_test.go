@@ -0,0 +1,131 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/palantir/duo-bot/mfa/duo"
+)
+
+func TestPushInfo(t *testing.T) {
+	logger := log.NewEntry(log.StandardLogger())
+
+	for name, tc := range map[string]struct {
+		meta MetadataPayload
+		want map[string]string
+	}{
+		"metadata":         {MetadataPayload{Metadata: map[string]string{"repo": "x"}}, map[string]string{"repo": "x"}},
+		"duoPushInfo":      {MetadataPayload{DuoPushInfo: "repo=x&branch=main"}, map[string]string{"repo": "x", "branch": "main"}},
+		"both":             {MetadataPayload{Metadata: map[string]string{"repo": "x"}, DuoPushInfo: "branch=main"}, map[string]string{"repo": "x", "branch": "main"}},
+		"given twice":      {MetadataPayload{Metadata: map[string]string{"repo": "x"}, DuoPushInfo: "repo=y"}, nil},
+		"repeated":         {MetadataPayload{DuoPushInfo: "repo=x&repo=y"}, nil},
+		"not URL-encoded":  {MetadataPayload{DuoPushInfo: "repo=%zz"}, nil},
+		"no name":          {MetadataPayload{Metadata: map[string]string{" ": "x"}}, nil},
+		"control in value": {MetadataPayload{Metadata: map[string]string{"repo": "x\ny"}}, nil},
+		"control in name":  {MetadataPayload{Metadata: map[string]string{"re\tpo": "x"}}, nil},
+		"encoded control":  {MetadataPayload{DuoPushInfo: "repo=x%0Ay"}, nil},
+		"unicode is fine":  {MetadataPayload{Metadata: map[string]string{"repo": "héllo"}}, map[string]string{"repo": "héllo"}},
+		"nothing to show":  {MetadataPayload{}, map[string]string{}},
+	} {
+		got, err := pushInfo(&tc.meta, logger)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", name, got, tc.want)
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("%s: got %v, want %v", name, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestRenderPush(t *testing.T) {
+	templated := PushTemplate{
+		Type: "Merge to {{.Metadata.branch}}",
+		Info: []PushFieldTemplate{{Name: "Repository", Value: "{{.Metadata.repo}}"}, {Name: "Caller", Value: "{{.Client}}"}},
+	}
+	big := strings.Repeat("x", duo.MaxPushInfoSize)
+
+	for name, tc := range map[string]struct {
+		push     PushTemplate
+		info     map[string]string
+		fields   string
+		pushType string
+		err      bool
+	}{
+		"key":                      {PushTemplate{}, map[string]string{"repo": "x"}, "Key=k&repo=x", "", false},
+		"key spoofed":              {PushTemplate{}, map[string]string{"Key": "other"}, "", "", true},
+		"key spoofed in lowercase": {PushTemplate{}, map[string]string{"key": "other"}, "", "", true},
+		"templated":                {templated, map[string]string{"repo": "x", "branch": "main"}, "Repository=x&Caller=ci&branch=main&repo=x", "Merge to main", false},
+		"empty fields left out":    {templated, map[string]string{"branch": "main"}, "Caller=ci&branch=main", "Merge to main", false},
+		"templated field spoofed":  {templated, map[string]string{"repo": "x", "CALLER": "someone"}, "", "", true},
+		"key not reserved":         {templated, map[string]string{"Key": "x"}, "Caller=ci&Key=x", "Merge to", false},
+		"control rendered":         {templated, map[string]string{"repo": "x\ny"}, "", "", true},
+		"too big":                  {PushTemplate{}, map[string]string{"big": big}, "", "", true},
+		"just fits":                {PushTemplate{}, map[string]string{"b": big[:duo.MaxPushInfoSize-len("Key=k&b=")]}, "", "", false},
+	} {
+		cp, err := tc.push.compile()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ns := Namespace{Name: "deploy", push: cp}
+		pc := promptConfig{user: "alice", pushInfo: tc.info}
+
+		err = ns.renderPush(&pc, "k", "ci")
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", name, pc.pushFields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := duo.EncodePushInfo(pc.pushFields); tc.fields != "" && got != tc.fields {
+			t.Errorf("%s: push info is %s, want %s", name, got, tc.fields)
+		}
+		if pc.pushType != tc.pushType {
+			t.Errorf("%s: push type is %q, want %q", name, pc.pushType, tc.pushType)
+		}
+	}
+}
+
+func TestCompilePushTemplate(t *testing.T) {
+	for name, push := range map[string]PushTemplate{
+		"no name":      {Info: []PushFieldTemplate{{Value: "x"}}},
+		"twice":        {Info: []PushFieldTemplate{{Name: "Repo", Value: "x"}, {Name: "Repo", Value: "y"}}},
+		"invalid type": {Type: "{{.Key"},
+		"invalid info": {Info: []PushFieldTemplate{{Name: "Repo", Value: "{{end}}"}}},
+	} {
+		if _, err := push.compile(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"github.com/palantir/duo-bot/receipt"
+)
+
+// jwksHandler publishes the keys receipts can be verified with
+func (s *Server) jwksHandler(c echo.Context) error {
+	if s.receipts == nil {
+		return c.String(http.StatusNotFound, "Receipts aren't enabled\n")
+	}
+	return c.JSON(http.StatusOK, s.receipts.JWKS())
+}
+
+// receiptFor signs a receipt for the valid check of key
+func (s *Server) receiptFor(key string, check checkResult) (string, error) {
+	return s.receipts.Sign(receipt.Claims{
+		Key:       key,
+		Namespace: s.namespaceFor(key).Name,
+		Binding:   check.binding,
+		Grant:     check.grant,
+	}, check.approval)
+}
@@ -15,80 +15,397 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	duoapi "github.com/duosecurity/duo_api_golang"
-	"github.com/duosecurity/duo_api_golang/authapi"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/pkg/errors"
 
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/duoclient"
+	"github.com/palantir/duo-bot/identity"
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/mfa/duo"
+	"github.com/palantir/duo-bot/receipt"
+	"github.com/palantir/duo-bot/redact"
 	"github.com/palantir/duo-bot/state"
+	"github.com/palantir/duo-bot/tracing"
 )
 
+// defaultClientHeader is the header a fronting proxy is expected to put the authenticated client's identity in
+const defaultClientHeader = "X-Forwarded-User"
+
+// Config is everything needed to build a Server
+type Config struct {
+	Addr    string
+	Version string
+
+	Duo duoclient.Config
+
+	// MFA providers besides DUO, which is always available as "duo"
+	Providers map[string]mfa.Provider
+	// Provider to prompt with for keys in no namespace, defaults to "duo"
+	DefaultProvider string
+	// Checked in order, the first with a pattern matching a key is that key's namespace
+	Namespaces []Namespace
+	// Optional, who can use a provider meant for when the usual one is down
+	BreakGlass BreakGlassPolicy
+	// Optional, named mappings from callers' usernames to the MFA provider's
+	Identities map[string]*identity.Mapper
+	// Identity mapping for keys in no namespace, usernames are used as given if empty
+	DefaultIdentity string
+	// Factors to try in order for prompts that leave it to us, defaults to defaultFactorPreference
+	FactorPreference []string
+	// How long a prompt that sent SMS passcodes waits for one, defaults to defaultPasscodeTTL
+	PasscodeTTL time.Duration
+	// How many SMS passcodes can be tried before the prompt is denied, defaults to defaultPasscodeAttempts
+	PasscodeAttempts int
+
+	// Header to read the calling client's identity from, defaults to defaultClientHeader
+	ClientHeader string
+	// IPs or CIDRs of proxies whose X-Forwarded-For is trusted, the client's IP is the connection's if empty
+	TrustedProxies []string
+	// Clients, as identified by ClientHeader, who can use the admin endpoints
+	Admins []string
+
+	// Only used to report on in readiness
+	ConfigFile string
+
+	// How often readiness probes DUO, defaults to defaultProbeInterval
+	ProbeInterval time.Duration
+	// Readiness fails if our clock is further than this from DUO's, defaults to defaultMaxClockSkew
+	MaxClockSkew time.Duration
+	// Readiness fails if more async pushes than this are in flight, defaults to defaultMaxTrackerBacklog
+	MaxTrackerBacklog int
+
+	// Scrubs secrets out of logs and errors, defaults to one that only scrubs the fields redact always does
+	Redactor *redact.Redactor
+	// Optional, nothing is audited if this is nil
+	AuditLog *audit.Log
+	// Optional, spans are created but never exported if this is nil
+	Tracer *tracing.Tracer
+	// Optional, checks can't return signed receipts if this is nil
+	Receipts *receipt.Signer
+
+	// How long in-flight async trackers get to finish at shutdown, defaults to defaultShutdownGrace
+	ShutdownGrace time.Duration
+	// How many async prompts are polled at once, defaults to defaultPollWorkers
+	PollWorkers int
+
+	// Optional, async prompts in flight are lost on restart if this is nil
+	Pending *state.PendingStore
+}
+
 // A Server is duo-bot run in server mode, the only mode
 type Server struct {
-	addr    string
-	version string
-	duo     *authapi.AuthApi
-	state   map[string]*state.Prompt
+	addr         string
+	version      string
+	duoAPI       *duoclient.Client
+	stateLock    sync.RWMutex
+	state        map[string]*state.Prompt
+	metrics      *serverMetrics
+	redact       *redact.Redactor
+	auditLog     *audit.Log
+	tracer       *tracing.Tracer
+	receipts     *receipt.Signer
+	clientHeader string
+	admins       []string
+
+	trustedProxies trustedProxies
+
+	providers       map[string]mfa.Provider
+	defaultProvider string
+	namespaces      []Namespace
+	breakGlass      BreakGlassPolicy
+	identities      map[string]*identity.Mapper
+	defaultIdentity string
+
+	factorPreference []string
+	enrollments      enrollments
+	grants           grants
+	passcodeTTL      time.Duration
+	passcodeAttempts int
+
+	health            healthChecks
+	duoProbe          duoProbe
+	probeInterval     time.Duration
+	maxClockSkew      time.Duration
+	maxTrackerBacklog int
+	configFile        string
+	configLoaded      time.Time
+
+	trackers      trackerSet
+	poller        *poller
+	shutdownGrace time.Duration
+	pending       *state.PendingStore
+}
+
+// Start starts the server listening on the given port, and blocks until it's shut down by SIGTERM or SIGINT
+func (s *Server) Start() error {
+	e := s.router()
+
+	// DUO being briefly unreachable shouldn't stop us from starting, readiness reports it until it's back
+	log.Info("Running initial DUO checks")
+	if err := s.probeDuo(context.Background()); err != nil {
+		log.Warn(errors.Wrap(err, "Initial DUO checks failed, starting degraded"))
+	}
+	probeCtx, stopProbes := context.WithCancel(context.Background())
+	defer stopProbes()
+	go s.runDuoProbes(probeCtx)
+	for _, m := range s.identities {
+		go m.Watch(probeCtx)
+	}
+
+	s.poller.start(s.trackers.ctx)
+	s.resumePending()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigc)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- e.Start(s.addr)
+	}()
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "server stopped")
+	case sig := <-sigc:
+		log.Infof("Got %v, shutting down", sig)
+	}
+
+	return s.shutdown(e)
 }
 
-// Start starts the server listening on the given port
-func (s *Server) Start() {
+// router returns the HTTP API
+func (s *Server) router() *echo.Echo {
 	e := echo.New()
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: `{"time":"${time_rfc3339_nano}","id":"${id}","remote_ip":"${remote_ip}","x_forwarded_for":"${header:X-Forwarded-For}",host":"${host}",` +
 			`"method":"${method}","uri":"${uri}","status":${status}, "latency":${latency},` +
 			`"latency_human":"${latency_human}","bytes_in":${bytes_in},` +
 			`"bytes_out":${bytes_out}}` + "\n",
+		// The uri can carry passcodes from older clients
+		Output: s.redact.Writer(os.Stdout),
 	}))
 	e.Use(middleware.Recover())
+	e.Use(s.traceMiddleware)
 
-	err := s.duoCheck()
-	if err != nil {
-		e.Logger.Fatal(errors.Wrap(err, "Error running initial DUO checks"))
-	}
-
-	e.GET("/v1/health", s.healthHandler)
+	// /v1/health predates the split into liveness and readiness, and is kept as liveness
+	e.GET("/v1/health", s.liveHandler)
+	e.GET("/v1/health/live", s.liveHandler)
+	e.GET("/v1/health/ready", s.readyHandler)
+	e.GET("/metrics", echo.WrapHandler(s.metrics.registry))
 	e.GET("/v1/check/:key", s.checkHandler)
+	e.GET("/v1/users/:user/devices", s.devicesHandler)
+	e.GET("/v1/enroll/:user/status", s.enrollStatusHandler)
+	e.GET("/v1/receipts/jwks.json", s.jwksHandler)
+	e.GET("/v1/admin/grants", s.listGrantsHandler)
 
 	e.POST("/v1/push/:key", s.pushHandler)
 	e.POST("/v1/passcode/:key", s.passcodeHandler)
 	e.POST("/v1/sms/:key", s.smsHandler)
 	e.POST("/v1/phone/:key", s.phoneHandler)
+	e.POST("/v1/auth/:key", s.autoHandler)
+	e.POST("/v1/enroll/:user", s.enrollHandler)
+	e.POST("/v1/grant/:namespace", s.grantHandler)
+
+	e.DELETE("/v1/admin/grants/:id", s.revokeGrantHandler)
 
-	e.Logger.Fatal(e.Start(s.addr))
+	return e
 }
 
 // New initializes a server with its config
-func New(addr string, version string, duoHost string, duoIkey string, duoSkey string) (*Server, error) {
+func New(cfg Config) (*Server, error) {
 	var s Server
 
-	s.addr = addr
-	s.version = version
-	duo := authapi.NewAuthApi(*duoapi.NewDuoApi(duoIkey, duoSkey, duoHost, "DUO bot"))
-	s.duo = duo
-
+	s.addr = cfg.Addr
+	s.version = cfg.Version
 	s.state = make(map[string]*state.Prompt)
+	s.metrics = s.newServerMetrics()
+	s.redact = cfg.Redactor
+	if s.redact == nil {
+		s.redact = redact.New(nil, nil)
+	}
+	s.auditLog = cfg.AuditLog
+	s.tracer = cfg.Tracer
+	s.receipts = cfg.Receipts
+
+	if cfg.Duo.UserAgent == "" {
+		cfg.Duo.UserAgent = "DUO bot"
+	}
+	cfg.Duo.Observer = &duoObserver{
+		metrics: s.metrics,
+		tracer:  s.tracer,
+	}
+	api, err := duoclient.New(cfg.Duo)
+	if err != nil {
+		return nil, errors.Wrap(err, "error configuring DUO client")
+	}
+	s.duoAPI = api
 
-	log.Debugf("Initialized DUO to point at host %s", duoHost)
+	s.providers = map[string]mfa.Provider{duo.Name: duo.New(api)}
+	for name, p := range cfg.Providers {
+		if _, ok := s.providers[name]; ok {
+			return nil, errors.Errorf("MFA provider '%s' is configured twice", name)
+		}
+		s.providers[name] = p
+	}
+	s.defaultProvider = cfg.DefaultProvider
+	if s.defaultProvider == "" {
+		s.defaultProvider = duo.Name
+	}
+	if _, ok := s.providers[s.defaultProvider]; !ok {
+		return nil, errors.Errorf("default MFA provider '%s' is not configured", s.defaultProvider)
+	}
+	s.identities = cfg.Identities
+	s.defaultIdentity = cfg.DefaultIdentity
+	if _, ok := s.identities[s.defaultIdentity]; s.defaultIdentity != "" && !ok {
+		return nil, errors.Errorf("default identity mapping '%s' is not configured", s.defaultIdentity)
+	}
+	if err := s.validateNamespaces(cfg.Namespaces); err != nil {
+		return nil, errors.Wrap(err, "error configuring namespaces")
+	}
+	if err := s.validateBreakGlass(cfg.BreakGlass); err != nil {
+		return nil, errors.Wrap(err, "error configuring break-glass")
+	}
+
+	s.factorPreference = cfg.FactorPreference
+	if len(s.factorPreference) == 0 {
+		s.factorPreference = defaultFactorPreference
+	}
+	for _, factor := range s.factorPreference {
+		if !contains(defaultFactorPreference, factor) {
+			return nil, errors.Errorf("can't prefer factor '%s', only %v can be chosen automatically", factor, defaultFactorPreference)
+		}
+	}
+
+	s.passcodeTTL = cfg.PasscodeTTL
+	if s.passcodeTTL <= 0 {
+		s.passcodeTTL = defaultPasscodeTTL
+	}
+	s.passcodeAttempts = cfg.PasscodeAttempts
+	if s.passcodeAttempts <= 0 {
+		s.passcodeAttempts = defaultPasscodeAttempts
+	}
+
+	s.trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "error configuring trusted proxies")
+	}
+
+	s.clientHeader = cfg.ClientHeader
+	if s.clientHeader == "" {
+		s.clientHeader = defaultClientHeader
+	}
+	s.admins = cfg.Admins
+
+	s.configFile = cfg.ConfigFile
+	s.configLoaded = time.Now()
+
+	s.probeInterval = cfg.ProbeInterval
+	if s.probeInterval <= 0 {
+		s.probeInterval = defaultProbeInterval
+	}
+	s.maxClockSkew = cfg.MaxClockSkew
+	if s.maxClockSkew <= 0 {
+		s.maxClockSkew = defaultMaxClockSkew
+	}
+	s.maxTrackerBacklog = cfg.MaxTrackerBacklog
+	if s.maxTrackerBacklog <= 0 {
+		s.maxTrackerBacklog = defaultMaxTrackerBacklog
+	}
+
+	s.trackers = newTrackerSet()
+	s.poller = newPoller(&s, cfg.PollWorkers)
+	s.shutdownGrace = cfg.ShutdownGrace
+	if s.shutdownGrace <= 0 {
+		s.shutdownGrace = defaultShutdownGrace
+	}
+	s.pending = cfg.Pending
+
+	s.registerHealthChecks()
+
+	log.Debugf("Initialized DUO to point at host %s", cfg.Duo.Host)
 
 	return &s, nil
 }
 
-func (s *Server) isValid(key string, user string) (bool, string) {
-	p := s.state[key]
-	if p != nil {
-		return p.IsValid(user)
+func (s *Server) getPrompt(key string) *state.Prompt {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	return s.state[key]
+}
+
+// checkResult is whether a key checks out, and why
+type checkResult struct {
+	valid bool
+	msg   string
+	// The approved prompt's metadata
+	metadata map[string]string
+	// The parts of the context the approval is bound to that the check presented differently
+	mismatches []string
+	// Who approved the prompt, and the context they approved it in, if it's valid
+	approval state.Approval
+	binding  *state.Binding
+	// The grant that approved the key, if it wasn't approved itself
+	grant string
+}
+
+// isValid checks key was approved by user, for the context the check presents from client if it's bound to one.
+// Keys without an approval of their own are valid if a grant covers them.
+func (s *Server) isValid(key string, user string, presented map[string]string, client string) checkResult {
+	p := s.getPrompt(key)
+	if p == nil {
+		if res, ok := s.grantedCheck(key, user); ok {
+			return res
+		}
+		return checkResult{msg: "No validation record found\n"}
+	}
+	valid, msg := p.IsValid(user)
+	if !valid {
+		if res, ok := s.grantedCheck(key, user); ok {
+			return res
+		}
+		return checkResult{msg: msg}
 	}
-	return false, "No validation record found\n"
+
+	b := p.Binding()
+	if b != nil {
+		if mismatches := b.Mismatches(presented, client); len(mismatches) > 0 {
+			return checkResult{
+				msg:        fmt.Sprintf("Approval is for a different %s, check with the context it was approved for\n", strings.Join(mismatches, ", ")),
+				mismatches: mismatches,
+			}
+		}
+	}
+	approval, _ := p.Approval()
+	return checkResult{valid: true, msg: msg, metadata: p.Metadata(), approval: approval, binding: b}
 }
 
-func (s *Server) resetStateForKey(key string, user string) time.Time {
+// restorePrompt puts p back in state for key, as it was before a restart
+func (s *Server) restorePrompt(key string, p *state.Prompt) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.state[key] = p
+}
+
+func (s *Server) resetStateForKey(key string, user string) (time.Time, *state.Prompt) {
 	ts := time.Now()
 	p := state.NewPrompt(ts, user)
+
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
 	s.state[key] = p
-	return ts
+
+	return ts, p
 }
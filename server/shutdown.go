@@ -0,0 +1,196 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/state"
+)
+
+const (
+	defaultShutdownGrace = 30 * time.Second
+	// Even past the grace period, in-flight HTTP requests get this long to finish
+	minHTTPShutdown = 5 * time.Second
+)
+
+// trackerSet is every async tracker in flight, and whatever they left unfinished at shutdown
+type trackerSet struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	inFlight map[*duoTXNTracker]struct{}
+	draining bool
+	deadline time.Time
+
+	// Cancelled once the grace period is over, trackers still running at that point give up
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	unfinished []state.PendingTxn
+}
+
+func newTrackerSet() trackerSet {
+	ctx, cancel := context.WithCancel(context.Background())
+	return trackerSet{
+		inFlight: make(map[*duoTXNTracker]struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// startTracker runs d in the background, unless we're draining, in which case d is left for the next start to pick up
+func (s *Server) startTracker(d *duoTXNTracker) {
+	// Written through before anything else, so it's picked back up even if we crash
+	s.persistPending(d)
+
+	s.trackers.mu.Lock()
+	defer s.trackers.mu.Unlock()
+
+	// The prompt has already gone out, so this can only happen to a request that raced the start of a drain
+	if s.trackers.draining {
+		d.logger.Warn("Shutting down, not tracking async prompt")
+		s.trackers.unfinished = append(s.trackers.unfinished, d.pending())
+		return
+	}
+
+	s.trackers.inFlight[d] = struct{}{}
+	s.trackers.wg.Add(1)
+	s.metrics.asyncTrackers.Inc()
+
+	d.begin()
+	s.poller.enqueue(d)
+}
+
+// endTracker records that d is no longer in flight, either because DUO answered or because we gave up at shutdown
+func (s *Server) endTracker(d *duoTXNTracker, finished bool) {
+	if finished {
+		s.forgetPending(d)
+	}
+
+	s.trackers.mu.Lock()
+	defer s.trackers.mu.Unlock()
+
+	if !finished {
+		s.trackers.unfinished = append(s.trackers.unfinished, d.pending())
+	}
+	delete(s.trackers.inFlight, d)
+	s.metrics.asyncTrackers.Dec()
+	s.trackers.wg.Done()
+}
+
+func (s *Server) isDraining() bool {
+	s.trackers.mu.Lock()
+	defer s.trackers.mu.Unlock()
+	return s.trackers.draining
+}
+
+// shutdown stops taking new prompts, gives in-flight trackers until the end of the grace period to finish,
+// then stops serving HTTP, leaving whatever trackers didn't finish for the next start
+func (s *Server) shutdown(e *echo.Echo) error {
+	deadline := time.Now().Add(s.shutdownGrace)
+
+	s.trackers.mu.Lock()
+	s.trackers.draining = true
+	s.trackers.deadline = deadline
+	inFlight := len(s.trackers.inFlight)
+	s.trackers.mu.Unlock()
+
+	// Keep serving checks and readiness while we wait, so callers can still use what's already been approved
+	log.Infof("Draining %d async trackers, waiting up to %v", inFlight, s.shutdownGrace)
+
+	done := make(chan struct{})
+	go func() {
+		s.trackers.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		log.Info("All async trackers finished")
+	case <-timer.C:
+		s.trackers.mu.Lock()
+		inFlight = len(s.trackers.inFlight)
+		s.trackers.mu.Unlock()
+		log.Warnf("Grace period over with %d async trackers still in flight, stopping them", inFlight)
+		s.trackers.cancel()
+		<-done
+	}
+
+	httpTimeout := time.Until(deadline)
+	if httpTimeout < minHTTPShutdown {
+		httpTimeout = minHTTPShutdown
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	defer cancel()
+
+	var shutdownErr error
+	if err := e.Shutdown(ctx); err != nil {
+		shutdownErr = errors.Wrap(err, "error shutting down HTTP server")
+	}
+
+	// Only once HTTP is down can nothing else be left unfinished
+	s.reportUnfinished()
+
+	return shutdownErr
+}
+
+// reportUnfinished logs what's been left for the next start to pick up, they've been persisted all along
+func (s *Server) reportUnfinished() {
+	s.trackers.mu.Lock()
+	unfinished := append([]state.PendingTxn(nil), s.trackers.unfinished...)
+	s.trackers.mu.Unlock()
+
+	if s.pending == nil {
+		for _, p := range unfinished {
+			log.WithFields(log.Fields{
+				"key":   p.Key,
+				"user":  p.User,
+				"TXNID": p.TxID,
+			}).Warn("No state.pending_file configured, dropping unfinished async prompt")
+		}
+		return
+	}
+
+	log.Infof("Left %d unfinished async prompts in %s", len(unfinished), s.pending.Path())
+}
+
+func (s *Server) shutdownHealth() componentStatus {
+	s.trackers.mu.Lock()
+	defer s.trackers.mu.Unlock()
+
+	st := componentStatus{
+		Healthy: true,
+		Details: map[string]interface{}{
+			"draining": s.trackers.draining,
+		},
+	}
+	if s.trackers.draining {
+		st.Healthy = false
+		st.Message = "Shutting down, not accepting new prompts"
+		st.Details["inFlight"] = len(s.trackers.inFlight)
+		st.Details["deadline"] = s.trackers.deadline.UTC().Format(time.RFC3339)
+	}
+
+	return st
+}
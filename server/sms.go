@@ -0,0 +1,140 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/audit"
+	"github.com/palantir/duo-bot/mfa"
+	"github.com/palantir/duo-bot/state"
+)
+
+const (
+	// How long a prompt awaits one of the passcodes sent by SMS
+	defaultPasscodeTTL = 5 * time.Minute
+	// How many passcodes the user can try before the prompt is denied
+	defaultPasscodeAttempts = 3
+
+	// The factor that sends passcodes, rather than prompting
+	smsFactor = "sms"
+)
+
+// completePasscode answers prompt p, which sent user passcodes, with passcode.  It's refused unless p is still awaiting
+// one from user, and provider sent them.
+func (s *Server) completePasscode(c echo.Context, req *requestInfo, logger *log.Entry, key string, user string, provider mfa.Provider, p *state.Prompt, passcode string) error {
+	logger = logger.WithField("completes", smsFactor)
+
+	fail := func(status int, result string, msg string) error {
+		logger.Error(msg)
+		s.audit(req, audit.Event{
+			Type:     audit.EventDuoResponse,
+			Key:      key,
+			User:     user,
+			Factor:   "passcode",
+			Result:   result,
+			Message:  msg,
+			Metadata: map[string]string{"completes": smsFactor},
+		})
+		return c.String(status, msg)
+	}
+
+	if passcode == "" {
+		return fail(http.StatusBadRequest, "error", "To use factor=passcode, you must specify a passcode\n")
+	}
+
+	if sentBy, _ := p.SentPasscodes(); sentBy != provider.Name() {
+		return fail(http.StatusBadRequest, "error", fmt.Sprintf("Prompt failed: the passcodes were sent by %s, not %s\n", sentBy, provider.Name()))
+	}
+
+	created, err := p.StartPasscodeAttempt(user)
+	if err != nil {
+		if p.Status() == state.StatusTimedOut {
+			s.transition(req, key, user, smsFactor, state.StatusTimedOut, err.Error())
+		}
+		return fail(http.StatusBadRequest, "error", fmt.Sprintf("Prompt failed: %s\n", err))
+	}
+
+	res, err := provider.VerifyPasscode(c.Request().Context(), mfa.PasscodeRequest{
+		User:     user,
+		Passcode: passcode,
+		IPAddr:   req.ipAddr(),
+	})
+	if err != nil {
+		msg := errors.Wrap(err, "Error from DUO")
+		// The attempt is used up either way, but the prompt keeps waiting for another
+		if mfa.IsUnavailable(err) {
+			logger.Error(msg)
+			return c.String(http.StatusServiceUnavailable, "MFA provider is unavailable, try again later\n")
+		}
+		return s.passcodeFailed(c, req, logger, key, user, p, s.redact.String(msg.Error()))
+	}
+
+	if res.Status != mfa.StatusAllowed {
+		return s.passcodeFailed(c, req, logger, key, user, p, fmt.Sprintf("Prompt failed: %s\n", res.Message))
+	}
+
+	s.audit(req, audit.Event{
+		Type:     audit.EventDuoResponse,
+		Key:      key,
+		User:     user,
+		Factor:   "passcode",
+		Result:   "allow",
+		Message:  res.Message,
+		Metadata: map[string]string{"completes": smsFactor},
+	})
+	out := fmt.Sprintf("Prompt successful: %s", res.Message)
+	logger.Info(out)
+	if err := p.TryAllow(created, smsFactor); err != nil {
+		s.transition(req, key, user, smsFactor, state.StatusDenied, err.Error())
+		logger.Error(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	s.transition(req, key, user, smsFactor, state.StatusAllowed, "")
+
+	return c.String(http.StatusOK, out)
+}
+
+// passcodeFailed records a wrong passcode for p, denying it if the user is out of tries
+func (s *Server) passcodeFailed(c echo.Context, req *requestInfo, logger *log.Entry, key string, user string, p *state.Prompt, msg string) error {
+	left := p.PasscodeFailed()
+	if left == 0 {
+		msg += "No attempts left, request new passcodes\n"
+	} else {
+		msg += fmt.Sprintf("%d attempts left\n", left)
+	}
+
+	logger.Error(msg)
+	s.audit(req, audit.Event{
+		Type:     audit.EventDuoResponse,
+		Key:      key,
+		User:     user,
+		Factor:   "passcode",
+		Result:   "deny",
+		Message:  msg,
+		Metadata: map[string]string{"completes": smsFactor, "attemptsLeft": fmt.Sprint(left)},
+	})
+	if left == 0 {
+		s.transition(req, key, user, smsFactor, state.StatusDenied, msg)
+	}
+
+	return c.String(http.StatusBadRequest, msg)
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo"
+
+	"github.com/palantir/duo-bot/tracing"
+)
+
+// traceMiddleware wraps every request in a server span, continuing the caller's trace if they sent a traceparent
+func (s *Server) traceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := req.Context()
+
+		if sc, ok := tracing.ParseTraceparent(req.Header.Get(tracing.TraceparentHeader)); ok {
+			ctx = tracing.ContextWithParent(ctx, sc)
+		}
+
+		ctx, span := s.tracer.Start(ctx, fmt.Sprintf("%s %s", req.Method, c.Path()), tracing.KindServer)
+		defer span.End()
+
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.route", c.Path())
+		// Older clients send passcodes in the query string
+		span.SetAttribute("http.target", s.redact.String(req.RequestURI))
+		span.SetAttribute("net.peer.ip", s.clientIP(c.Request()))
+		if key := c.Param("key"); key != "" {
+			span.SetAttribute("duobot.key", key)
+		}
+
+		// Let the caller find this request's trace
+		c.Response().Header().Set(tracing.TraceparentHeader, span.SpanContext().Traceparent())
+
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			span.SetError(err)
+			// Let echo write the error response now, so its status is what we record
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		span.SetAttribute("http.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("HTTP %d", status))
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sort"
+)
+
+// ClientField names the calling client's identity among a binding's mismatches
+const ClientField = "client"
+
+// A Binding ties an approval to the context it was given in, so it can't be replayed for a different operation
+// that reuses the key.  Only hashes of the context are kept.
+type Binding struct {
+	// Hashes of the bound metadata fields' values, by field name
+	Fields map[string]string `json:"fields,omitempty"`
+	// Hash of the calling client's identity, if it's bound
+	Client string `json:"client,omitempty"`
+}
+
+// NewBinding returns a Binding to fields, and to client if bindClient is set
+func NewBinding(fields map[string]string, client string, bindClient bool) *Binding {
+	b := Binding{
+		Fields: make(map[string]string, len(fields)),
+	}
+	for name, value := range fields {
+		b.Fields[name] = bindingHash(name, value)
+	}
+	if bindClient {
+		b.Client = bindingHash(ClientField, client)
+	}
+	return &b
+}
+
+// Mismatches returns the names of the bound fields whose values in fields differ from those bound, in name
+// order, followed by ClientField if client isn't the one bound
+func (b *Binding) Mismatches(fields map[string]string, client string) []string {
+	var mismatches []string
+	for name, hash := range b.Fields {
+		if !hashesEqual(hash, bindingHash(name, fields[name])) {
+			mismatches = append(mismatches, name)
+		}
+	}
+	sort.Strings(mismatches)
+
+	if b.Client != "" && !hashesEqual(b.Client, bindingHash(ClientField, client)) {
+		mismatches = append(mismatches, ClientField)
+	}
+	return mismatches
+}
+
+// bindingHash hashes a field's name along with its value, so values can't be swapped between fields
+func bindingHash(name string, value string) string {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashesEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
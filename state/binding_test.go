@@ -0,0 +1,56 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBindingMismatches(t *testing.T) {
+	bound := map[string]string{"repo": "x/y", "sha": "abc"}
+	b := NewBinding(bound, "ci", true)
+
+	for name, tc := range map[string]struct {
+		fields map[string]string
+		client string
+		want   []string
+	}{
+		"same":          {bound, "ci", nil},
+		"extra field":   {map[string]string{"repo": "x/y", "sha": "abc", "env": "prod"}, "ci", nil},
+		"changed field": {map[string]string{"repo": "x/y", "sha": "def"}, "ci", []string{"sha"}},
+		"missing field": {map[string]string{"sha": "abc"}, "ci", []string{"repo"}},
+		"other client":  {bound, "laptop", []string{ClientField}},
+		"everything":    {map[string]string{}, "", []string{"repo", "sha", ClientField}},
+	} {
+		if got := b.Mismatches(tc.fields, tc.client); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got mismatches %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestBindingUnboundClient(t *testing.T) {
+	b := NewBinding(map[string]string{"repo": "x/y"}, "ci", false)
+	if got := b.Mismatches(map[string]string{"repo": "x/y"}, "laptop"); len(got) != 0 {
+		t.Errorf("client isn't bound, but mismatched %v", got)
+	}
+}
+
+func TestBindingSwappedValues(t *testing.T) {
+	b := NewBinding(map[string]string{"a": "1", "b": "2"}, "", false)
+	if got := b.Mismatches(map[string]string{"a": "2", "b": "1"}, ""); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("values swapped between fields, got mismatches %v", got)
+	}
+}
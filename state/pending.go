@@ -0,0 +1,153 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/palantir/duo-bot/atomicfile"
+)
+
+// PendingTxn is an async MFA transaction we haven't heard the end of yet
+type PendingTxn struct {
+	Key    string `json:"key"`
+	User   string `json:"user"`
+	Factor string `json:"factor"`
+	// The MFA provider the transaction is with, transactions saved before there was a choice are DUO's
+	Provider string `json:"provider,omitempty"`
+	TxID     string `json:"txid"`
+	// When the prompt this transaction is for was created, only that generation of the prompt may be allowed by it
+	Created time.Time `json:"created"`
+	// When the transaction was sent, if it's a fallback sent after the prompt was created
+	Sent time.Time `json:"sent,omitempty"`
+	// Factors still to fall back to if the user doesn't answer
+	Fallback []string `json:"fallback,omitempty"`
+	// The name fallbacks show the user, if not User
+	DisplayUsername string `json:"displayUsername,omitempty"`
+	// What the prompt showed the user, for fallbacks to show again and checks to return
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// The context checks have to present, if the prompt is bound to one
+	Binding *Binding `json:"binding,omitempty"`
+
+	// Who asked for the prompt, so what happens to it can still be audited
+	RequestID string `json:"requestID,omitempty"`
+	Client    string `json:"client,omitempty"`
+	SourceIP  string `json:"sourceIP,omitempty"`
+}
+
+// SavePending writes txns to path, replacing whatever was there
+func SavePending(path string, txns []PendingTxn) error {
+	b, err := json.MarshalIndent(txns, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error serializing pending transactions")
+	}
+
+	return errors.Wrapf(atomicfile.WriteFile(path, b, 0600), "error writing pending transactions to %s", path)
+}
+
+// LoadPending reads txns saved by SavePending.  A missing file means there's nothing pending.
+func LoadPending(path string) ([]PendingTxn, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading pending transactions from %s", path)
+	}
+
+	var txns []PendingTxn
+	if err := json.Unmarshal(b, &txns); err != nil {
+		return nil, errors.Wrapf(err, "error parsing pending transactions in %s", path)
+	}
+	return txns, nil
+}
+
+// PendingStore keeps the set of pending transactions written through to a file as it changes,
+// so they survive a crash as well as a clean shutdown.  It's safe for concurrent use.
+type PendingStore struct {
+	path string
+	mu   sync.Mutex
+	txns map[string]PendingTxn
+}
+
+// OpenPendingStore opens the store in path, starting out with whatever was pending there
+func OpenPendingStore(path string) (*PendingStore, error) {
+	txns, err := LoadPending(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := PendingStore{
+		path: path,
+		txns: make(map[string]PendingTxn),
+	}
+	for _, txn := range txns {
+		s.txns[txn.TxID] = txn
+	}
+	return &s, nil
+}
+
+// Path returns the file the store writes through to
+func (s *PendingStore) Path() string {
+	return s.path
+}
+
+// Add records txn as pending
+func (s *PendingStore) Add(txn PendingTxn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txns[txn.TxID] = txn
+	return s.save()
+}
+
+// Remove records that the transaction with txid is no longer pending
+func (s *PendingStore) Remove(txid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.txns[txid]; !ok {
+		return nil
+	}
+	delete(s.txns, txid)
+	return s.save()
+}
+
+// All returns every pending transaction, oldest first
+func (s *PendingStore) All() []PendingTxn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted()
+}
+
+func (s *PendingStore) sorted() []PendingTxn {
+	txns := make([]PendingTxn, 0, len(s.txns))
+	for _, txn := range s.txns {
+		txns = append(txns, txn)
+	}
+	sort.Slice(txns, func(i, j int) bool {
+		return txns[i].Created.Before(txns[j].Created)
+	})
+	return txns
+}
+
+func (s *PendingStore) save() error {
+	return SavePending(s.path, s.sorted())
+}
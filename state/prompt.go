@@ -16,6 +16,7 @@ package state
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -34,13 +35,61 @@ const (
 	StatusDenied
 	// StatusPending means the prompt is still outstanding and we don't yet know if it's allowed or denied
 	StatusPending
+	// StatusTimedOut means we stopped waiting to hear whether the prompt was allowed or denied
+	StatusTimedOut
+	// StatusAwaitingPasscode means passcodes have been sent to the user, and the prompt is waiting for one of them
+	StatusAwaitingPasscode
 )
 
-// Prompt object holds information about an MFA prompt
+func (s PromptStatus) String() string {
+	switch s {
+	case StatusAllowed:
+		return "allowed"
+	case StatusDenied:
+		return "denied"
+	case StatusPending:
+		return "pending"
+	case StatusTimedOut:
+		return "timed_out"
+	case StatusAwaitingPasscode:
+		return "awaiting_passcode"
+	default:
+		return "unknown"
+	}
+}
+
+// Prompt object holds information about an MFA prompt, it's safe for concurrent use
 type Prompt struct {
+	mu      sync.Mutex
 	created time.Time
 	user    string
 	status  PromptStatus
+	// Set while the prompt is awaiting a passcode
+	wait *passcodeWait
+	// What the prompt showed the user, returned with checks
+	metadata map[string]string
+	// Optional, the context checks have to present for the prompt to be valid
+	binding *Binding
+	// Set once the prompt is allowed
+	approved time.Time
+	factor   string
+}
+
+// An Approval is who allowed a prompt, with what factor and when
+type Approval struct {
+	User   string
+	Factor string
+	At     time.Time
+	// Checks stop accepting the approval after this
+	Expires time.Time
+}
+
+// passcodeWait is how long a prompt awaits a passcode, and how many tries the user gets
+type passcodeWait struct {
+	provider    string
+	expires     time.Time
+	attempts    int
+	maxAttempts int
 }
 
 // NewPrompt returns a Prompt object, setting valid to nil because the request is still in flight
@@ -54,33 +103,202 @@ func NewPrompt(created time.Time, user string) *Prompt {
 	return &p
 }
 
+// SetMetadata records the key/value pairs the prompt showed the user
+func (p *Prompt) SetMetadata(metadata map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metadata = copyMetadata(metadata)
+}
+
+// Metadata returns the key/value pairs the prompt showed the user
+func (p *Prompt) Metadata() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return copyMetadata(p.metadata)
+}
+
+// SetBinding binds the prompt to the context it was given in
+func (p *Prompt) SetBinding(b *Binding) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.binding = b
+}
+
+// Binding returns the context the prompt is bound to, or nil if it isn't
+func (p *Prompt) Binding() *Binding {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.binding
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
+
 // Deny marks a prompt as denied
 func (p *Prompt) Deny() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.status = StatusDenied
 }
 
-// Don't let outsiders call this directly, they have to call TryAllow
-func (p *Prompt) allow() {
+// TimeOut marks a prompt that's still pending or awaiting a passcode as timed out
+func (p *Prompt) TimeOut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status == StatusPending || p.status == StatusAwaitingPasscode {
+		p.status = StatusTimedOut
+	}
+}
+
+// Status returns the current status of the prompt
+func (p *Prompt) Status() PromptStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireWait()
+	return p.status
+}
+
+// expireWait times the prompt out if it's been awaiting a passcode too long.  p.mu must be held.
+func (p *Prompt) expireWait() {
+	if p.status == StatusAwaitingPasscode && time.Now().After(p.wait.expires) {
+		p.status = StatusTimedOut
+	}
+}
+
+// AwaitPasscode marks a pending prompt as awaiting a passcode from provider, iff the time given matches the
+// time of the prompt.  The user gets maxAttempts tries at it before ttl is up.
+func (p *Prompt) AwaitPasscode(created time.Time, provider string, ttl time.Duration, maxAttempts int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.created != created || p.status != StatusPending {
+		p.status = StatusDenied
+		return errors.Errorf("prompt created at %v is no longer the pending one, rejecting", created)
+	}
+
+	p.status = StatusAwaitingPasscode
+	p.wait = &passcodeWait{
+		provider:    provider,
+		expires:     time.Now().Add(ttl),
+		maxAttempts: maxAttempts,
+	}
+	return nil
+}
+
+// SentPasscodes returns which provider sent passcodes for the prompt, if it did, whether it's still awaiting one
+// or has since been answered, denied or expired.  Only StartPasscodeAttempt decides whether another one can be tried.
+func (p *Prompt) SentPasscodes() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wait == nil {
+		return "", false
+	}
+	return p.wait.provider, true
+}
+
+// StartPasscodeAttempt uses up one of the user's tries at the passcode, returning the prompt's created time to
+// TryAllow with if the passcode's right
+func (p *Prompt) StartPasscodeAttempt(user string) (time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireWait()
+
+	switch {
+	case p.status == StatusTimedOut && p.wait != nil:
+		return time.Time{}, errors.New("the passcodes sent have expired, request new ones")
+	case p.status == StatusDenied && p.wait != nil:
+		return time.Time{}, errors.New("the prompt was denied, request new passcodes")
+	case p.status == StatusAllowed && p.wait != nil:
+		return time.Time{}, errors.New("the prompt has already been allowed, request new passcodes to prompt again")
+	case p.status != StatusAwaitingPasscode:
+		return time.Time{}, errors.New("the prompt isn't awaiting a passcode")
+	case p.user != user:
+		return time.Time{}, errors.Errorf("the prompt is awaiting a passcode from %s, not %s", p.user, user)
+	case p.wait.attempts >= p.wait.maxAttempts:
+		return time.Time{}, errors.New("no attempts left, request new passcodes")
+	}
+
+	p.wait.attempts++
+	return p.created, nil
+}
+
+// PasscodeFailed records a wrong passcode, denying the prompt once the user's out of tries.
+// It returns how many tries are left.
+func (p *Prompt) PasscodeFailed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.status != StatusAwaitingPasscode {
+		return 0
+	}
+	left := p.wait.maxAttempts - p.wait.attempts
+	if left <= 0 {
+		p.status = StatusDenied
+		return 0
+	}
+	return left
+}
+
+// Don't let outsiders call this directly, they have to call TryAllow (which holds the lock)
+func (p *Prompt) allow(factor string) {
 	p.status = StatusAllowed
+	p.approved = time.Now()
+	p.factor = factor
 }
 
-// TryAllow will mark the MFA prompt as allowed, iff the time given matches the time of the prompt
-// If there is a time mismatch, the prompt will be marked as denied
-func (p *Prompt) TryAllow(created time.Time) error {
-	// Created time I'm checking on is the same one in state, so we're good
-	if p.created == created {
-		p.allow()
-		return nil
+// TryAllow will mark the MFA prompt as allowed with factor, iff the time given matches the time of the prompt and
+// it's still pending or awaiting a passcode.  If there is a time mismatch, the prompt will be marked as denied.
+func (p *Prompt) TryAllow(created time.Time, factor string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.created != created {
+		// There must have been an attempted race on validations, so fail closed
+		p.status = StatusDenied
+		return errors.Errorf("created time for this request (%v) doesn't match pending time in state (%v), rejecting", created, p.created)
+	}
+
+	// A slow answer can't undo the prompt being denied or timing out while it was out, e.g. the last passcode
+	// attempt failing while another was still being verified
+	p.expireWait()
+	if p.status != StatusPending && p.status != StatusAwaitingPasscode {
+		return errors.Errorf("prompt is already %s, rejecting", p.status)
 	}
 
-	// There must have been an attempted race on validations, so fail closed
-	p.Deny()
-	return errors.Errorf("created time for this request (%v) doesn't match pending time in state (%v), rejecting", created, p.created)
+	p.allow(factor)
+	return nil
+}
+
+// Approval returns who allowed the prompt, if it's been allowed
+func (p *Prompt) Approval() (Approval, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status != StatusAllowed {
+		return Approval{}, false
+	}
+	return Approval{
+		User:    p.user,
+		Factor:  p.factor,
+		At:      p.approved,
+		Expires: p.created.Add(maxAge),
+	}, true
 }
 
 // IsValid returns whether or not the prompt is valid, as well as a string giving more context
 // passing-in a user is optional - if you don't, success doesn't depend on who accepted the MFA
 func (p *Prompt) IsValid(user string) (bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	now := time.Now()
 	fmtTime := p.created.UTC().Format(time.RFC822)
 
@@ -92,6 +310,15 @@ func (p *Prompt) IsValid(user string) (bool, string) {
 		return false, fmt.Sprintf("Pending request out for user %s created at %s, please try again\n", p.user, fmtTime)
 	}
 
+	p.expireWait()
+	if p.status == StatusAwaitingPasscode {
+		return false, fmt.Sprintf("Waiting for user %s to enter the passcode sent at %s\n", p.user, fmtTime)
+	}
+
+	if p.status == StatusTimedOut {
+		return false, fmt.Sprintf("Request for user %s created at %s timed out, try again\n", p.user, fmtTime)
+	}
+
 	if user != "" && user != p.user {
 		return false, fmt.Sprintf("Only record for key is for user %s at %s (you required user %s)\n", p.user, fmtTime, user)
 	}
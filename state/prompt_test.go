@@ -0,0 +1,104 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func awaiting(t *testing.T, ttl time.Duration, maxAttempts int) (*Prompt, time.Time) {
+	created := time.Now()
+	p := NewPrompt(created, "alice")
+	if err := p.AwaitPasscode(created, "duo", ttl, maxAttempts); err != nil {
+		t.Fatal(err)
+	}
+	return p, created
+}
+
+func TestTryAllow(t *testing.T) {
+	created := time.Now()
+	p := NewPrompt(created, "alice")
+	if err := p.TryAllow(created, "push"); err != nil || p.Status() != StatusAllowed {
+		t.Errorf("pending prompt wasn't allowed: %v", err)
+	}
+
+	p = NewPrompt(created, "alice")
+	if err := p.TryAllow(created.Add(-time.Second), "push"); err == nil || p.Status() != StatusDenied {
+		t.Errorf("prompt was allowed for another request, status %v", p.Status())
+	}
+
+	p = NewPrompt(created, "alice")
+	p.TimeOut()
+	if err := p.TryAllow(created, "push"); err == nil || p.Status() != StatusTimedOut {
+		t.Errorf("timed out prompt was allowed, status %v", p.Status())
+	}
+}
+
+// The last attempt failing denies the prompt, even if another is still being verified and then succeeds
+func TestTryAllowAfterAttemptsUsedUp(t *testing.T) {
+	p, _ := awaiting(t, time.Minute, 2)
+
+	slow, err := p.StartPasscodeAttempt("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.StartPasscodeAttempt("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.StartPasscodeAttempt("alice"); err == nil {
+		t.Fatal("got a third attempt out of two")
+	}
+	if left := p.PasscodeFailed(); left != 0 || p.Status() != StatusDenied {
+		t.Fatalf("expected the prompt to be denied with no attempts left, %d left and %v", left, p.Status())
+	}
+
+	if err := p.TryAllow(slow, "sms"); err == nil || p.Status() != StatusDenied {
+		t.Errorf("denied prompt was allowed, status %v", p.Status())
+	}
+}
+
+func TestTryAllowAfterWaitExpired(t *testing.T) {
+	p, created := awaiting(t, 10*time.Millisecond, 3)
+	if _, err := p.StartPasscodeAttempt("alice"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err := p.TryAllow(created, "sms"); err == nil || p.Status() != StatusTimedOut {
+		t.Errorf("expired prompt was allowed, status %v", p.Status())
+	}
+	if _, err := p.StartPasscodeAttempt("alice"); err == nil {
+		t.Error("got an attempt at an expired prompt")
+	}
+}
+
+func TestSentPasscodes(t *testing.T) {
+	if _, ok := NewPrompt(time.Now(), "alice").SentPasscodes(); ok {
+		t.Error("prompt that never sent passcodes says it did")
+	}
+
+	p, _ := awaiting(t, time.Minute, 1)
+	if _, err := p.StartPasscodeAttempt("bob"); err == nil {
+		t.Error("got an attempt at a prompt awaiting another user's passcode")
+	}
+	p.StartPasscodeAttempt("alice")
+	p.PasscodeFailed()
+
+	// Still true once it's denied, so a passcode for the key isn't taken as a new prompt
+	if provider, ok := p.SentPasscodes(); !ok || provider != "duo" {
+		t.Errorf("denied prompt doesn't say duo sent it passcodes, got %q", provider)
+	}
+}
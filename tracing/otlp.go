@@ -0,0 +1,295 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultEndpoint is where a collector running next to duo-bot listens for OTLP/HTTP
+	DefaultEndpoint = "http://localhost:4318/v1/traces"
+
+	exportBatchSize = 512
+	exportInterval  = 5 * time.Second
+	exportQueueSize = 4096
+	exportTimeout   = 10 * time.Second
+)
+
+// An Exporter batches finished spans and sends them to an OTLP/HTTP collector
+type Exporter struct {
+	endpoint    string
+	serviceName string
+	version     string
+	client      *http.Client
+
+	queue chan *Span
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewExporter starts exporting spans to the OTLP/HTTP traces endpoint, on behalf of serviceName
+func NewExporter(endpoint string, serviceName string, version string) *Exporter {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+
+	e := Exporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		version:     version,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, exportQueueSize),
+		done:        make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return &e
+}
+
+func (e *Exporter) export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		// Tracing must never slow down or block the thing being traced
+		log.Debug("Trace export queue full, dropping span")
+	}
+}
+
+// Shutdown exports anything still queued and stops the exporter
+func (e *Exporter) Shutdown() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *Exporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Warn(errors.Wrapf(err, "Error exporting %d spans, dropping them", len(batch)))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					send()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *Exporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return errors.Wrap(err, "error serializing spans")
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "error sending spans to %s", e.endpoint)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector at %s returned %s", e.endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of ExportTraceServiceRequest, just the parts we use
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	// 0 unset, 1 ok, 2 error
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *Exporter) request(spans []*Span) otlpRequest {
+	var out []otlpSpan
+	for _, s := range spans {
+		out = append(out, s.toOTLP())
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: attributes(map[string]interface{}{
+					"service.name":    e.serviceName,
+					"service.version": e.version,
+				}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/palantir/duo-bot/tracing", Version: e.version},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attributes(s.attrs),
+	}
+
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	for _, l := range s.linkedSCs {
+		o.Links = append(o.Links, otlpLink{
+			TraceID: hex.EncodeToString(l.TraceID[:]),
+			SpanID:  hex.EncodeToString(l.SpanID[:]),
+		})
+	}
+
+	if s.hasErr {
+		o.Status = otlpStatus{Code: 2, Message: s.errMsg}
+	}
+
+	return o
+}
+
+func attributes(attrs map[string]interface{}) []otlpKeyValue {
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []otlpKeyValue
+	for _, k := range keys {
+		var v otlpValue
+		switch val := attrs[k].(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			i := strconv.Itoa(val)
+			v.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(val, 10)
+			v.IntValue = &i
+		case float64:
+			v.DoubleValue = &val
+		default:
+			continue
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing is a small OpenTelemetry-compatible tracer: spans propagate over W3C trace context
+// and are exported to a collector over OTLP/HTTP with JSON encoding.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind is the OpenTelemetry span kind, with OTLP's numbering
+type SpanKind int
+
+const (
+	// KindInternal is work inside duo-bot, like an async tracker
+	KindInternal SpanKind = 1
+	// KindServer is an incoming HTTP request
+	KindServer SpanKind = 2
+	// KindClient is an outgoing call, like to DUO
+	KindClient SpanKind = 3
+)
+
+// TraceparentHeader is the W3C trace context header
+const TraceparentHeader = "traceparent"
+
+// A SpanContext is what identifies a span across process boundaries
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid returns whether sc identifies a span at all
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent renders sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value, returning false if it isn't valid
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	return sc, sc.IsValid()
+}
+
+// A Tracer creates spans and hands finished ones to its exporter.
+// A nil *Tracer is valid, and creates spans that are never exported.
+type Tracer struct {
+	exporter *Exporter
+}
+
+// NewTracer returns a Tracer exporting to exporter
+func NewTracer(exporter *Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// A Span is a single timed operation
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     SpanKind
+	sc       SpanContext
+	parentID [8]byte
+	start    time.Time
+
+	mu        sync.Mutex
+	end       time.Time
+	attrs     map[string]interface{}
+	errMsg    string
+	hasErr    bool
+	ended     bool
+	linkedSCs []SpanContext
+}
+
+type spanKey struct{}
+type parentKey struct{}
+
+// FromContext returns the span in ctx, or nil if there isn't one
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan returns a copy of ctx carrying s, so spans started from it are its children
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// ContextWithParent returns a copy of ctx whose next span is a child of the span identified by sc,
+// which may be in another process or may have already ended
+func ContextWithParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, parentKey{}, sc)
+}
+
+// Start starts a span as a child of whatever span or parent is in ctx, returning a context carrying it
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	s := Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+
+	var parent SpanContext
+	if p := FromContext(ctx); p != nil {
+		parent = p.sc
+	} else if sc, ok := ctx.Value(parentKey{}).(SpanContext); ok {
+		parent = sc
+	}
+
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		randomID(s.sc.TraceID[:])
+		s.sc.Sampled = true
+	}
+	randomID(s.sc.SpanID[:])
+
+	return ContextWithSpan(ctx, &s), &s
+}
+
+func randomID(b []byte) {
+	// crypto/rand only fails if the OS can't give us randomness at all
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// SpanContext returns the identifiers of s, for propagating it
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a string, bool, int, int64 or float64 attribute on s
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks s as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hasErr = true
+	s.errMsg = err.Error()
+}
+
+// AddLink links s to another span, which is related but not its parent
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linkedSCs = append(s.linkedSCs, sc)
+}
+
+// End finishes s and queues it for export.  Only the first call does anything.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.tracer != nil && s.tracer.exporter != nil && s.sc.Sampled {
+		s.tracer.exporter.export(s)
+	}
+}